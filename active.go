@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/sha1"
+	"hash"
+	"sync"
+	"time"
+)
+
+const (
+	BLOCKTIMEOUT = 20 * time.Second // after this a block request can go to another peer
+	STALLTIMEOUT = 45 * time.Second // a peer that sends no blocks for this long is dropped
+)
+
+// activePieces tracks the pieces that are being downloaded block by block.
+// Several peers can fill in the blocks of one piece, the blocks we got stay
+// when a peer goes away and requests that take too long are handed to
+// someone else. Once every piece is handed out we go into endgame and idle
+// workers join the pieces that are left, the first block to arrive wins and
+// the other peers get a cancel for it.
+type activePieces struct {
+	mu     sync.Mutex
+	pieces map[int]*activePiece
+}
+
+type activePiece struct {
+	p        *piece
+	buf      []byte
+	received map[int]bool                  // begin of the blocks we have
+	pending  map[int]map[*client]time.Time // begin of the requested blocks, who has them and since when
+	workers  map[*client]bool
+	queued   bool          // the piece is back with the picker
+	verify   bool          // every block is in and the piece waits for its hash check
+	done     chan struct{} // closed once the piece is verified
+
+	// the hash is advanced as the blocks at the front of the piece come in,
+	// blocks that arrive out of order wait in buf until the gap is filled
+	hashMu sync.Mutex // taken before the lock of activePieces
+	hash   hash.Hash
+	hashed int // bytes of buf that went into the hash
+}
+
+func newActivePiece(p *piece) *activePiece {
+	return &activePiece{
+		p:        p,
+		buf:      make([]byte, p.length),
+		received: make(map[int]bool),
+		pending:  make(map[int]map[*client]time.Time),
+		workers:  make(map[*client]bool),
+		done:     make(chan struct{}),
+		hash:     sha1.New(),
+	}
+}
+
+func newActivePieces() *activePieces {
+	return &activePieces{
+		pieces: make(map[int]*activePiece),
+	}
+}
+
+// start puts c to work on a piece from the picker, picking up the blocks
+// earlier workers left behind.
+func (a *activePieces) start(p *piece, c *client) *activePiece {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, ok := a.pieces[p.index]
+	if !ok {
+		ap = newActivePiece(p)
+		a.pieces[p.index] = ap
+	}
+	ap.workers[c] = true
+	ap.queued = false
+
+	return ap
+}
+
+// restore brings back the blocks of a piece we got before a restart, the
+// piece waits for a worker like one whose workers all left.
+func (a *activePieces) restore(p *piece, blocks map[int][]byte) {
+	ap := newActivePiece(p)
+	ap.queued = true
+	for begin, block := range blocks {
+		copy(ap.buf[begin:], block)
+		ap.received[begin] = true
+	}
+
+	a.mu.Lock()
+	a.pieces[p.index] = ap
+	a.mu.Unlock()
+
+	a.hashBlocks(ap)
+}
+
+// partials copies the blocks we got of every unfinished piece.
+func (a *activePieces) partials() map[int]map[int][]byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	partial := make(map[int]map[int][]byte)
+	for index, ap := range a.pieces {
+		if len(ap.received) == 0 || ap.finished() {
+			continue
+		}
+
+		blocks := make(map[int][]byte)
+		for begin := range ap.received {
+			length := blockSize(ap.p.length, begin)
+			blocks[begin] = append([]byte{}, ap.buf[begin:begin+length]...)
+		}
+		partial[index] = blocks
+	}
+
+	return partial
+}
+
+// started reports whether we have some of the blocks of the piece.
+func (a *activePieces) started(index int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, ok := a.pieces[index]
+	return ok && len(ap.received) > 0
+}
+
+// partialPiece finds a piece someone else started that still has blocks
+// nobody is waiting for, so we finish pieces before starting new ones.
+func (a *activePieces) partialPiece(c *client) *activePiece {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for index, ap := range a.pieces {
+		if ap.workers[c] || !c.bitfield.HasPiece(index) {
+			continue
+		}
+
+		for begin := 0; begin < ap.p.length; begin += MAXBLOCKSIZE {
+			if !ap.received[begin] && ap.numWaiting(begin, now) == 0 {
+				ap.workers[c] = true
+				return ap
+			}
+		}
+	}
+
+	return nil
+}
+
+// endgamePiece finds an unfinished piece the peer has that c isn't working
+// on yet, the one with the fewest workers so they are spread out.
+func (a *activePieces) endgamePiece(c *client) *activePiece {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var best *activePiece
+	for index, ap := range a.pieces {
+		if ap.workers[c] || ap.verify || !c.bitfield.HasPiece(index) {
+			continue
+		}
+		if best == nil || len(ap.workers) < len(best.workers) {
+			best = ap
+		}
+	}
+
+	if best != nil {
+		best.workers[c] = true
+	}
+
+	return best
+}
+
+// latePiece finds a piece past its deadline that c isn't working on yet, c
+// joins it like in endgame so it comes in sooner.
+func (a *activePieces) latePiece(c *client, d deadliner) *activePiece {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for index, ap := range a.pieces {
+		if ap.workers[c] || ap.verify || !c.bitfield.HasPiece(index) {
+			continue
+		}
+
+		if deadline, ok := d.Deadline(index); ok && now.After(deadline) {
+			ap.workers[c] = true
+			return ap
+		}
+	}
+
+	return nil
+}
+
+// leave takes c off the piece and drops its requests, the blocks we got are
+// kept. It reports whether c was the last worker on an unfinished piece so
+// the piece has to go back to the picker.
+func (a *activePieces) leave(ap *activePiece, c *client) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(ap.workers, c)
+	for begin, peers := range ap.pending {
+		delete(peers, c)
+		if len(peers) == 0 {
+			delete(ap.pending, begin)
+		}
+	}
+
+	// a piece in verification is put back by reset if it turns out bad
+	if len(ap.workers) > 0 || ap.queued || ap.verify || ap.finished() {
+		return false
+	}
+	ap.queued = true
+
+	return true
+}
+
+// nextBlock picks the next block c should request. Blocks nobody is waiting
+// for go first, in endgame c also asks for blocks other peers have pending.
+func (a *activePieces) nextBlock(ap *activePiece, c *client, endgame bool) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	candidate := -1
+	for begin := 0; begin < ap.p.length; begin += MAXBLOCKSIZE {
+		if _, asked := ap.pending[begin][c]; ap.received[begin] || asked {
+			continue
+		}
+
+		if ap.numWaiting(begin, now) == 0 {
+			candidate = begin
+			break
+		}
+		if endgame && candidate < 0 {
+			candidate = begin
+		}
+	}
+
+	if candidate < 0 {
+		return 0, false
+	}
+
+	if ap.pending[candidate] == nil {
+		ap.pending[candidate] = make(map[*client]time.Time)
+	}
+	ap.pending[candidate][c] = now
+
+	return candidate, true
+}
+
+// numPending is the number of blocks of the piece c is waiting for, requests
+// that timed out don't count.
+func (a *activePieces) numPending(ap *activePiece, c *client) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, peers := range ap.pending {
+		if at, ok := peers[c]; ok && now.Sub(at) < BLOCKTIMEOUT {
+			n++
+		}
+	}
+
+	return n
+}
+
+// numWaiting is the number of peers we asked for the block that haven't
+// timed out yet.
+func (ap *activePiece) numWaiting(begin int, now time.Time) int {
+	n := 0
+	for _, at := range ap.pending[begin] {
+		if now.Sub(at) < BLOCKTIMEOUT {
+			n++
+		}
+	}
+
+	return n
+}
+
+// receive stores a block c got. It returns the other peers that still have
+// the block pending and whether the block completed the piece, which is true
+// for exactly one caller.
+func (a *activePieces) receive(ap *activePiece, c *client, begin int, block []byte) ([]*client, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if begin%MAXBLOCKSIZE != 0 || len(block) != blockSize(ap.p.length, begin) {
+		return nil, false
+	}
+
+	peers := ap.pending[begin]
+	delete(ap.pending, begin)
+	if ap.received[begin] {
+		return nil, false // someone beat c to it
+	}
+
+	copy(ap.buf[begin:], block)
+	ap.received[begin] = true
+
+	others := []*client{}
+	for peer := range peers {
+		if peer != c {
+			others = append(others, peer)
+		}
+	}
+
+	complete := len(ap.received)*MAXBLOCKSIZE >= ap.p.length
+	if complete {
+		ap.verify = true
+	}
+
+	return others, complete
+}
+
+// drop forgets that c asked for the block, after a reject or a choke.
+func (a *activePieces) drop(ap *activePiece, c *client, begin int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(ap.pending[begin], c)
+	if len(ap.pending[begin]) == 0 {
+		delete(ap.pending, begin)
+	}
+}
+
+func (a *activePieces) dropAll(ap *activePiece, c *client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for begin, peers := range ap.pending {
+		delete(peers, c)
+		if len(peers) == 0 {
+			delete(ap.pending, begin)
+		}
+	}
+}
+
+// finish marks a verified piece as done, the other workers on it move on.
+func (a *activePieces) finish(ap *activePiece) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	close(ap.done)
+	delete(a.pieces, ap.p.index)
+	ap.buf = nil // the piece is in the store now
+}
+
+// reset throws away the blocks of a piece that failed its hash check. Like
+// leave it reports whether the piece has to go back to the picker, the
+// workers may have moved on while it was checked.
+func (a *activePieces) reset(ap *activePiece) bool {
+	ap.hashMu.Lock()
+	defer ap.hashMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap.received = make(map[int]bool)
+	ap.verify = false
+	ap.hash.Reset()
+	ap.hashed = 0
+
+	if len(ap.workers) > 0 || ap.queued {
+		return false
+	}
+	ap.queued = true
+
+	return true
+}
+
+// hashBlocks feeds the blocks at the front of the piece we haven't hashed
+// yet to its hash. It runs outside of the lock of activePieces so peers
+// hashing different pieces don't wait on each other.
+func (a *activePieces) hashBlocks(ap *activePiece) {
+	ap.hashMu.Lock()
+	defer ap.hashMu.Unlock()
+
+	for {
+		a.mu.Lock()
+		next := ap.hashed < ap.p.length && ap.received[ap.hashed]
+		a.mu.Unlock()
+		if !next {
+			return
+		}
+
+		// a received block isn't written to again until reset, which
+		// waits for us
+		end := ap.hashed + blockSize(ap.p.length, ap.hashed)
+		ap.hash.Write(ap.buf[ap.hashed:end])
+		ap.hashed = end
+	}
+}
+
+// digest is the hash of the piece once every block is in and hashed.
+func (ap *activePiece) digest() ([20]byte, bool) {
+	ap.hashMu.Lock()
+	defer ap.hashMu.Unlock()
+
+	var sum [20]byte
+	if ap.hashed < ap.p.length {
+		return sum, false
+	}
+	copy(sum[:], ap.hash.Sum(nil))
+
+	return sum, true
+}
+
+func (ap *activePiece) finished() bool {
+	select {
+	case <-ap.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+	"time"
+)
+
+func TestEndgameCancels(t *testing.T) {
+	a := newActivePieces()
+	slow, fast := &client{}, &client{bitfield: fullBitfield(1)}
+	p := &piece{index: 0, length: 2*MAXBLOCKSIZE + 100}
+
+	ap := a.start(p, slow)
+	for i := 0; i < 3; i++ {
+		if _, ok := a.nextBlock(ap, slow, false); !ok {
+			t.Fatalf("expected block %d to be handed out", i)
+		}
+	}
+
+	// outside of endgame there is nothing left for a second peer
+	if a.endgamePiece(fast) != ap {
+		t.Fatalf("expected the fast peer to join the piece")
+	}
+	if _, ok := a.nextBlock(ap, fast, false); ok {
+		t.Fatalf("expected no block outside of endgame")
+	}
+
+	begin, ok := a.nextBlock(ap, fast, true)
+	if !ok || begin != 0 {
+		t.Fatalf("expected the first block in endgame, got=%d %v", begin, ok)
+	}
+
+	others, complete := a.receive(ap, fast, 0, bytes.Repeat([]byte{1}, MAXBLOCKSIZE))
+	if complete || len(others) != 1 || others[0] != slow {
+		t.Fatalf("expected the slow peer to get a cancel, got=%v %v", others, complete)
+	}
+
+	// the slow peer's copy arrives late and is ignored
+	if _, complete := a.receive(ap, slow, 0, bytes.Repeat([]byte{2}, MAXBLOCKSIZE)); complete || ap.buf[0] != 1 {
+		t.Fatalf("expected the late block to be dropped")
+	}
+
+	a.receive(ap, slow, MAXBLOCKSIZE, make([]byte, MAXBLOCKSIZE))
+	_, complete = a.receive(ap, slow, 2*MAXBLOCKSIZE, make([]byte, 100))
+	if !complete {
+		t.Fatalf("expected the last block to complete the piece")
+	}
+
+	a.finish(ap)
+	if a.leave(ap, slow) || a.leave(ap, fast) {
+		t.Fatalf("expected a finished piece to stay off the queue")
+	}
+}
+
+func TestBlocksSurviveLeaving(t *testing.T) {
+	a := newActivePieces()
+	first, second := &client{}, &client{bitfield: fullBitfield(1)}
+	p := &piece{index: 0, length: 3 * MAXBLOCKSIZE}
+
+	ap := a.start(p, first)
+	a.nextBlock(ap, first, false)
+	a.nextBlock(ap, first, false)
+	a.receive(ap, first, 0, make([]byte, MAXBLOCKSIZE))
+
+	// the peer goes away with a block still pending
+	if !a.leave(ap, first) {
+		t.Fatalf("expected the piece to go back on the queue")
+	}
+
+	if a.start(p, second) != ap {
+		t.Fatalf("expected the next worker to pick up the same piece")
+	}
+	begin, ok := a.nextBlock(ap, second, false)
+	if !ok || begin != MAXBLOCKSIZE {
+		t.Fatalf("expected the dropped block to be asked for again, got=%d %v", begin, ok)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	a := newActivePieces()
+	slow, other := &client{}, &client{bitfield: fullBitfield(1)}
+	p := &piece{index: 0, length: MAXBLOCKSIZE}
+
+	ap := a.start(p, slow)
+	a.nextBlock(ap, slow, false)
+
+	if a.partialPiece(other) != nil {
+		t.Fatalf("expected no free block while the request is fresh")
+	}
+
+	ap.pending[0][slow] = time.Now().Add(-BLOCKTIMEOUT)
+	if a.numPending(ap, slow) != 0 {
+		t.Fatalf("expected the timed out request not to count")
+	}
+	if a.partialPiece(other) != ap {
+		t.Fatalf("expected the timed out block to be up for grabs")
+	}
+	if begin, ok := a.nextBlock(ap, other, false); !ok || begin != 0 {
+		t.Fatalf("expected the block to be reassigned, got=%d %v", begin, ok)
+	}
+}
+
+func TestIncrementalHash(t *testing.T) {
+	data := make([]byte, 2*MAXBLOCKSIZE+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	p := &piece{0, sha1.Sum(data), len(data)}
+	a := newActivePieces()
+	ap := a.start(p, nil)
+
+	// a block ahead of a gap waits in the buffer
+	a.receive(ap, nil, MAXBLOCKSIZE, data[MAXBLOCKSIZE:2*MAXBLOCKSIZE])
+	a.hashBlocks(ap)
+	if ap.hashed != 0 {
+		t.Fatalf("expected nothing hashed before the first block, got=%d", ap.hashed)
+	}
+
+	a.receive(ap, nil, 0, data[:MAXBLOCKSIZE])
+	a.hashBlocks(ap)
+	if ap.hashed != 2*MAXBLOCKSIZE {
+		t.Fatalf("expected the first two blocks hashed, got=%d", ap.hashed)
+	}
+	if _, ok := ap.digest(); ok {
+		t.Fatalf("expected no digest before the last block")
+	}
+
+	a.receive(ap, nil, 2*MAXBLOCKSIZE, data[2*MAXBLOCKSIZE:])
+	a.hashBlocks(ap)
+	if sum, ok := ap.digest(); !ok || sum != p.hash {
+		t.Fatalf("expected the digest of the whole piece")
+	}
+
+	a.reset(ap)
+	if _, ok := ap.digest(); ok || ap.hashed != 0 {
+		t.Fatalf("expected reset to start the hash over")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type allocationMode int
+
+const (
+	allocateSparse allocationMode = iota // the files grow as the pieces come in
+	allocateFull                         // every file takes up its whole size up front
+)
+
+func parseAllocation(s string) (allocationMode, error) {
+	switch s {
+	case "sparse":
+		return allocateSparse, nil
+	case "full":
+		return allocateFull, nil
+	}
+
+	return 0, fmt.Errorf("unknown allocation %q, expected sparse or full", s)
+}
+
+// prepareFiles makes sure the disk under dir has room for what is left of
+// the torrent, and with full allocation reserves it right away. Whatever is
+// already in the files is kept.
+func prepareFiles(info *TorrentFile, dir string, mode allocationMode) error {
+	var needed int64
+	for _, f := range info.files {
+		stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.path)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		var allocated int64
+		if err == nil {
+			allocated = allocatedSize(stat)
+		}
+		needed += max(int64(f.length)-allocated, 0)
+	}
+
+	if needed > 0 {
+		free, err := freeSpace(dir)
+		if err != nil {
+			// not knowing is no reason to stop, the writes will tell us
+			fmt.Println("could not check the free disk space:", err)
+		} else if free < needed {
+			return fmt.Errorf("not enough disk space in %s: %d more bytes are needed for %s but only %d are free", dir, needed, info.name, free)
+		}
+	}
+
+	if mode != allocateFull {
+		return nil
+	}
+
+	files, err := openFiles(info, dir, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for i, f := range info.files {
+		err = preallocate(files[i], int64(f.length))
+		if err != nil {
+			return fmt.Errorf("could not allocate %s: %s", f.path, err)
+		}
+	}
+
+	return nil
+}
+
+// existingDir walks up from dir to the first directory that exists, the
+// download directory is only created once the files are.
+func existingDir(dir string) string {
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// writeZeros fills the file with zeros from its current end up to length.
+func writeZeros(file *os.File, length int64) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, 1<<20)
+	for off := stat.Size(); off < length; {
+		n := int64(len(zeros))
+		if length-off < n {
+			n = length - off
+		}
+
+		_, err := file.WriteAt(zeros[:n], off)
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+
+	return nil
+}
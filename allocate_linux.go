@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves length bytes for the file on disk, so it doesn't end
+// up in fragments and a full disk shows up now instead of halfway through.
+func preallocate(file *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	// mode 0 leaves whatever is in the file alone
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP {
+		// not every filesystem can do it, zeros do the same thing slower
+		return writeZeros(file, length)
+	}
+
+	return err
+}
+
+// allocatedSize is how much of the file is actually on disk, a sparse file
+// takes up less than its size.
+func allocatedSize(stat os.FileInfo) int64 {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return stat.Size()
+	}
+
+	return min(sys.Blocks*512, stat.Size())
+}
+
+// freeSpace is how many bytes unprivileged users can still write to the
+// filesystem dir is on.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(existingDir(dir), &fs)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd
+
+package main
+
+import (
+	"errors"
+)
+
+// freeSpace can't be found out without statfs, the download goes ahead and a
+// full disk shows up on the first write that doesn't fit.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("checking the free space is not supported on this system")
+}
@@ -0,0 +1,19 @@
+//go:build openbsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeSpace is how many bytes unprivileged users can still write to the
+// filesystem dir is on, openbsd prefixes the fields.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(existingDir(dir), &fs)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(fs.F_bavail) * int64(fs.F_bsize), nil
+}
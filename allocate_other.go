@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// preallocate reserves length bytes for the file by writing zeros past its
+// end, there is no fallocate outside of linux.
+func preallocate(file *os.File, length int64) error {
+	return writeZeros(file, length)
+}
+
+func allocatedSize(stat os.FileInfo) int64 {
+	return stat.Size()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareFiles(t *testing.T) {
+	info := multiFileTorrent(make([]byte, 100), 30, 10, 0, 50, 40)
+
+	dir := t.TempDir()
+	err := prepareFiles(info, dir, allocateSparse)
+	if err != nil {
+		t.Fatalf("could not prepare sparse files: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi")); !os.IsNotExist(err) {
+		t.Fatalf("expected sparse files to be left for the storage to create")
+	}
+
+	// full allocation keeps what is already there
+	name := filepath.Join(dir, "multi", "c")
+	os.MkdirAll(filepath.Dir(name), 0755)
+	os.WriteFile(name, []byte("partial"), 0644)
+
+	err = prepareFiles(info, dir, allocateFull)
+	if err != nil {
+		t.Fatalf("could not allocate the files: %s", err)
+	}
+	for _, f := range info.files {
+		stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.path)))
+		if err != nil {
+			t.Fatalf("expected %s to exist: %s", f.path, err)
+		}
+		if stat.Size() != int64(f.length) {
+			t.Fatalf("expected %s to be %d bytes, got=%d", f.path, f.length, stat.Size())
+		}
+	}
+
+	content, _ := os.ReadFile(name)
+	if string(content[:7]) != "partial" {
+		t.Fatalf("expected the allocation to keep the data, got=%q", content[:7])
+	}
+}
+
+func TestPrepareFilesNoSpace(t *testing.T) {
+	free, err := freeSpace(t.TempDir())
+	if err != nil {
+		t.Skipf("can't check the free space: %s", err)
+	}
+
+	info := &TorrentFile{name: "huge", length: int(free) + 1<<30}
+	info.files = []fileEntry{{path: info.name, length: info.length}}
+	if prepareFiles(info, t.TempDir(), allocateSparse) == nil {
+		t.Fatalf("expected a torrent bigger than the disk to be refused")
+	}
+}
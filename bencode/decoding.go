@@ -2,6 +2,7 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -66,6 +67,23 @@ func (d *Decoder) Decode() (interface{}, error) {
 	return d.decodeVal()
 }
 
+// DecodePrefix decodes the value at the start of data and returns how many
+// bytes it took up, for messages that put raw data after a bencoded value.
+func DecodePrefix(data []byte) (interface{}, int, error) {
+	r := bytes.NewReader(data)
+	d := NewDecoder(r)
+
+	val, err := d.decodeVal()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// whatever the decoder read ahead is still sitting in its buffer
+	n := len(data) - r.Len() - d.rd.Buffered()
+
+	return val, n, nil
+}
+
 func (d *Decoder) decodeVal() (interface{}, error) {
 	b, err := d.peek()
 	if err != nil {
@@ -167,6 +185,11 @@ func (d *Decoder) decodeList() (List, error) {
 		l = append(l, val)
 	}
 
+	// consume the closing 'e' so the enclosing value can keep decoding
+	if _, err := d.readByte(); err != nil {
+		return nil, err
+	}
+
 	return l, nil
 }
 
@@ -206,5 +229,9 @@ func (d *Decoder) decodeDict() (Dictionary, error) {
 		dict[string(k)] = val
 	}
 
+	if _, err := d.readByte(); err != nil {
+		return nil, err
+	}
+
 	return dict, nil
 }
@@ -60,11 +60,11 @@ func TestDecodeList(t *testing.T) {
 	}{
 		{
 			input:    "l4:spami34ee",
-			expected: List{"spam", 34},
+			expected: List{[]byte("spam"), 34},
 		},
 		{
 			input:    "li-45e5:helloe",
-			expected: List{-45, "hello"},
+			expected: List{-45, []byte("hello")},
 		},
 	}
 
@@ -97,13 +97,20 @@ func TestDecodeDictionary(t *testing.T) {
 			input: "d1:ai5e1:bl4:spam5:helloee",
 			expected: Dictionary{
 				"a": 5,
-				"b": List{"spam", "hello"},
+				"b": List{[]byte("spam"), []byte("hello")},
 			},
 		},
 		{
 			input:    "d6:myDictd1:ai10eee",
 			expected: Dictionary{"myDict": Dictionary{"a": 10}},
 		},
+		{
+			input: "d1:md6:ut_pexi1ee1:pi6881ee",
+			expected: Dictionary{
+				"m": Dictionary{"ut_pex": 1},
+				"p": 6881,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -123,3 +130,21 @@ func TestDecodeDictionary(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodePrefix(t *testing.T) {
+	input := "d8:msg_typei1e5:piecei0eeRAWDATA"
+
+	val, n, err := DecodePrefix([]byte(input))
+	if err != nil {
+		t.Fatalf("could not decode prefix: %s", err)
+	}
+
+	expected := Dictionary{"msg_type": 1, "piece": 0}
+	if !reflect.DeepEqual(val, expected) {
+		t.Fatalf("expected and value doesn't match, wanted=%v, got=%v", expected, val)
+	}
+
+	if input[n:] != "RAWDATA" {
+		t.Fatalf("expected the rest to be RAWDATA, got=%s", input[n:])
+	}
+}
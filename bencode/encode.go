@@ -3,6 +3,7 @@ package bencode
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 )
 
@@ -27,3 +28,72 @@ func EncodeInt(x int) []byte {
 
 	return out.Bytes()
 }
+
+// Encode bencodes strings, byte slices, ints, lists and dictionaries.
+// Dictionary keys are written in sorted order as the spec requires.
+func Encode(val interface{}) ([]byte, error) {
+	var out bytes.Buffer
+
+	err := encodeVal(&out, val)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func encodeVal(out *bytes.Buffer, val interface{}) error {
+	switch v := val.(type) {
+	case string:
+		out.Write(EncodeString(v))
+	case []byte:
+		out.Write(EncodeString(string(v)))
+	case int:
+		out.Write(EncodeInt(v))
+	case List:
+		return encodeList(out, v)
+	case []interface{}:
+		return encodeList(out, v)
+	case Dictionary:
+		return encodeDict(out, v)
+	case map[string]interface{}:
+		return encodeDict(out, v)
+	default:
+		return fmt.Errorf("can not bencode value of type %T", val)
+	}
+
+	return nil
+}
+
+func encodeList(out *bytes.Buffer, l []interface{}) error {
+	out.WriteByte('l')
+	for _, val := range l {
+		err := encodeVal(out, val)
+		if err != nil {
+			return err
+		}
+	}
+	out.WriteByte('e')
+
+	return nil
+}
+
+func encodeDict(out *bytes.Buffer, dict map[string]interface{}) error {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out.WriteByte('d')
+	for _, k := range keys {
+		out.Write(EncodeString(k))
+		err := encodeVal(out, dict[k])
+		if err != nil {
+			return err
+		}
+	}
+	out.WriteByte('e')
+
+	return nil
+}
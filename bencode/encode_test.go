@@ -0,0 +1,40 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{input: 42, expected: "i42e"},
+		{input: "spam", expected: "4:spam"},
+		{input: []byte("eggs"), expected: "4:eggs"},
+		{input: List{"spam", 34}, expected: "l4:spami34ee"},
+		{
+			input:    Dictionary{"p": 6881, "m": Dictionary{"ut_pex": 1}},
+			expected: "d1:md6:ut_pexi1ee1:pi6881ee",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := Encode(tt.input)
+		if err != nil {
+			t.Fatalf("expected to be able to encode %v, %s", tt.input, err)
+		}
+
+		if !bytes.Equal(got, []byte(tt.expected)) {
+			t.Fatalf("expected encoding to be %s, got=%s", tt.expected, got)
+		}
+	}
+}
+
+func TestEncodeUnsupported(t *testing.T) {
+	_, err := Encode(1.5)
+	if err == nil {
+		t.Fatalf("expected an error when encoding a float")
+	}
+}
@@ -2,6 +2,20 @@ package main
 
 type Bitfield []byte
 
+func newBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// fullBitfield is the bitfield of a peer that has every piece
+func fullBitfield(numPieces int) Bitfield {
+	bf := newBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
@@ -23,3 +37,13 @@ func (bf Bitfield) SetPiece(index int) {
 
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+func (bf Bitfield) Empty() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
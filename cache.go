@@ -0,0 +1,346 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	WRITECACHESIZE = 16 << 20 // bytes of unfinished pieces held back to be written together
+	READCACHESIZE  = 32 << 20 // bytes of pieces kept around for peers asking for them again
+)
+
+// cacheStats is what the caches of a storage did so far.
+type cacheStats struct {
+	readHits   int
+	readMisses int
+	writes     int // writes that went into the write cache
+	flushes    int // writes that went out to the storage
+}
+
+func (cs cacheStats) String() string {
+	return fmt.Sprintf("%d read hits, %d read misses, %d writes in %d flushes", cs.readHits, cs.readMisses, cs.writes, cs.flushes)
+}
+
+// cachedStorage sits in front of another storage. A piece goes out in one
+// write once all of it was written, the blocks of unfinished pieces are held
+// in the write cache until it is full or the storage is synced. The
+// read cache keeps whole pieces, so a peer asking for one block after the
+// other only costs one read from the disk.
+type cachedStorage struct {
+	mu      sync.Mutex
+	info    *TorrentFile
+	storage Storage
+
+	dirty      map[int]*dirtyPiece
+	dirtySize  int // bytes of memory the dirty pieces take up
+	writeLimit int
+
+	clean     map[int]*list.Element // of *cleanPiece, the most recently used at the front of lru
+	lru       *list.List
+	cleanSize int
+	readLimit int
+	stats     cacheStats
+}
+
+// dirtyPiece is a piece with writes that didn't reach the storage yet.
+type dirtyPiece struct {
+	buf    []byte
+	ranges [][2]int // the parts of buf that were written, sorted and not touching
+}
+
+type cleanPiece struct {
+	index int
+	buf   []byte
+}
+
+// newCachedStorage puts caches of the given sizes in bytes in front of
+// storage, a size of 0 turns that cache off.
+func newCachedStorage(info *TorrentFile, storage Storage, writeLimit, readLimit int) *cachedStorage {
+	return &cachedStorage{
+		info:       info,
+		storage:    storage,
+		dirty:      make(map[int]*dirtyPiece),
+		writeLimit: writeLimit,
+		clean:      make(map[int]*list.Element),
+		lru:        list.New(),
+		readLimit:  readLimit,
+	}
+}
+
+// add marks begin to end as written, merging it with the ranges it touches.
+func (dp *dirtyPiece) add(begin, end int) {
+	merged := [][2]int{}
+	for _, r := range dp.ranges {
+		if r[1] < begin || r[0] > end {
+			merged = append(merged, r)
+			continue
+		}
+		begin, end = min(begin, r[0]), max(end, r[1])
+	}
+	merged = append(merged, [2]int{begin, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i][0] < merged[j][0] })
+
+	dp.ranges = merged
+}
+
+func (dp *dirtyPiece) full() bool {
+	return len(dp.ranges) == 1 && dp.ranges[0][0] == 0 && dp.ranges[0][1] == len(dp.buf)
+}
+
+func (dp *dirtyPiece) covers(begin, end int) bool {
+	for _, r := range dp.ranges {
+		if r[0] <= begin && end <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cs *cachedStorage) ReadAt(p []byte, index, begin int) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	_, err := cs.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	end := begin + len(p)
+	if end > cs.info.pieceSize(index) {
+		// nobody reads across pieces but the storage can, after the
+		// writes it hasn't seen yet
+		err := cs.flush()
+		if err != nil {
+			return 0, err
+		}
+
+		return cs.storage.ReadAt(p, index, begin)
+	}
+
+	if dp, ok := cs.dirty[index]; ok {
+		if dp.covers(begin, end) {
+			cs.stats.readHits++
+			return copy(p, dp.buf[begin:end]), nil
+		}
+
+		err := cs.flushPieces([]int{index})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if e, ok := cs.clean[index]; ok {
+		cs.stats.readHits++
+		cs.lru.MoveToFront(e)
+		return copy(p, e.Value.(*cleanPiece).buf[begin:end]), nil
+	}
+	cs.stats.readMisses++
+
+	if cs.readLimit == 0 {
+		return cs.storage.ReadAt(p, index, begin)
+	}
+
+	buf := make([]byte, cs.info.pieceSize(index))
+	_, err = cs.storage.ReadAt(buf, index, 0)
+	if err != nil {
+		// the rest of the piece may not be on disk yet, the part we want
+		// can still be
+		return cs.storage.ReadAt(p, index, begin)
+	}
+	cs.remember(index, buf)
+
+	return copy(p, buf[begin:end]), nil
+}
+
+// remember puts a piece in the read cache and drops the least recently used
+// ones that don't fit anymore.
+func (cs *cachedStorage) remember(index int, buf []byte) {
+	cs.clean[index] = cs.lru.PushFront(&cleanPiece{index, buf})
+	cs.cleanSize += len(buf)
+
+	for cs.cleanSize > cs.readLimit {
+		cp := cs.lru.Remove(cs.lru.Back()).(*cleanPiece)
+		delete(cs.clean, cp.index)
+		cs.cleanSize -= len(cp.buf)
+	}
+}
+
+func (cs *cachedStorage) forget(index int) {
+	if e, ok := cs.clean[index]; ok {
+		cs.lru.Remove(e)
+		delete(cs.clean, index)
+		cs.cleanSize -= len(e.Value.(*cleanPiece).buf)
+	}
+}
+
+func (cs *cachedStorage) WriteAt(p []byte, index, begin int) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	off, err := cs.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	if cs.writeLimit == 0 {
+		for i := index; int64(i)*int64(cs.info.pieceLength) < off+int64(len(p)); i++ {
+			cs.forget(i)
+		}
+		cs.stats.flushes++
+
+		return cs.storage.WriteAt(p, index, begin)
+	}
+
+	// cut the write into the pieces it covers
+	full := []int{}
+	for n := 0; n < len(p); {
+		length := min(len(p)-n, cs.info.pieceSize(index)-begin)
+
+		dp, ok := cs.dirty[index]
+		if !ok {
+			dp = &dirtyPiece{buf: make([]byte, cs.info.pieceSize(index))}
+			cs.dirty[index] = dp
+			cs.dirtySize += len(dp.buf)
+		}
+		copy(dp.buf[begin:], p[n:n+length])
+		dp.add(begin, begin+length)
+		cs.forget(index)
+		if dp.full() {
+			full = append(full, index)
+		}
+
+		n += length
+		index, begin = index+1, 0
+	}
+	cs.stats.writes++
+
+	// a full piece was verified and announced, it goes out in one write
+	// right away and peers asking for it get it from the read cache
+	if len(full) > 0 {
+		bufs := make([][]byte, len(full))
+		for i, index := range full {
+			bufs[i] = cs.dirty[index].buf
+		}
+
+		err := cs.flushPieces(full)
+		if err != nil {
+			return len(p), err
+		}
+
+		if cs.readLimit > 0 {
+			for i, index := range full {
+				cs.remember(index, bufs[i])
+			}
+		}
+	}
+
+	// what is left are the blocks of unfinished pieces, they only go out
+	// when there are too many of them
+	if cs.dirtySize > cs.writeLimit {
+		err := cs.flush()
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush writes out every dirty piece.
+func (cs *cachedStorage) flush() error {
+	indexes := make([]int, 0, len(cs.dirty))
+	for index := range cs.dirty {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	return cs.flushPieces(indexes)
+}
+
+// flushPieces writes out the dirty pieces at the sorted indexes, runs of
+// full pieces go out in one write. Pieces that fail to go out stay dirty.
+func (cs *cachedStorage) flushPieces(indexes []int) error {
+	for i := 0; i < len(indexes); {
+		first := cs.dirty[indexes[i]]
+		if !first.full() {
+			for _, r := range first.ranges {
+				_, err := cs.storage.WriteAt(first.buf[r[0]:r[1]], indexes[i], r[0])
+				if err != nil {
+					return err
+				}
+				cs.stats.flushes++
+			}
+			cs.flushed(indexes[i])
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(indexes) && indexes[j] == indexes[j-1]+1 && cs.dirty[indexes[j]].full() {
+			j++
+		}
+
+		run := first.buf
+		if j-i > 1 {
+			run = make([]byte, 0, (j-i)*cs.info.pieceLength)
+			for _, index := range indexes[i:j] {
+				run = append(run, cs.dirty[index].buf...)
+			}
+		}
+
+		_, err := cs.storage.WriteAt(run, indexes[i], 0)
+		if err != nil {
+			return err
+		}
+		cs.stats.flushes++
+
+		for _, index := range indexes[i:j] {
+			cs.flushed(index)
+		}
+		i = j
+	}
+
+	return nil
+}
+
+// flushed drops a piece that made it to the storage from the write cache.
+func (cs *cachedStorage) flushed(index int) {
+	cs.dirtySize -= len(cs.dirty[index].buf)
+	delete(cs.dirty, index)
+}
+
+func (cs *cachedStorage) Sync() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	err := cs.flush()
+	if err != nil {
+		return err
+	}
+
+	return cs.storage.Sync()
+}
+
+func (cs *cachedStorage) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	err := cs.flush()
+	if err != nil {
+		cs.storage.Close()
+		return err
+	}
+
+	return cs.storage.Close()
+}
+
+func (cs *cachedStorage) currentStats() cacheStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.stats
+}
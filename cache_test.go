@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// countingStorage counts the reads and writes that reach the storage.
+type countingStorage struct {
+	*memoryStorage
+	reads  int
+	writes [][2]int // index and length of every write
+}
+
+func (cs *countingStorage) ReadAt(p []byte, index, begin int) (int, error) {
+	cs.reads++
+	return cs.memoryStorage.ReadAt(p, index, begin)
+}
+
+func (cs *countingStorage) WriteAt(p []byte, index, begin int) (int, error) {
+	cs.writes = append(cs.writes, [2]int{index, len(p)})
+	return cs.memoryStorage.WriteAt(p, index, begin)
+}
+
+func TestWriteCacheCoalesces(t *testing.T) {
+	data := make([]byte, 5*32768+1000)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+	under := &countingStorage{memoryStorage: newMemoryStorage(info, nil)}
+	cs := newCachedStorage(info, under, 1<<20, 0)
+
+	// the blocks of piece 4 in a mixed up order, it stays in the cache until
+	// it is complete
+	cs.WriteAt(data[4*32768+MAXBLOCKSIZE:5*32768], 4, MAXBLOCKSIZE)
+
+	block := make([]byte, 100)
+	cs.ReadAt(block, 4, MAXBLOCKSIZE+500)
+	if !bytes.Equal(block, data[4*32768+MAXBLOCKSIZE+500:4*32768+MAXBLOCKSIZE+600]) || len(under.writes) != 0 {
+		t.Fatalf("expected the read to come from the write cache")
+	}
+
+	cs.WriteAt(data[4*32768:4*32768+MAXBLOCKSIZE], 4, 0)
+	if len(under.writes) != 1 || under.writes[0] != [2]int{4, 32768} {
+		t.Fatalf("expected the complete piece to go out in one write, got=%v", under.writes)
+	}
+	if !bytes.Equal(under.data[4*32768:5*32768], data[4*32768:5*32768]) {
+		t.Fatalf("expected the storage to hold what was written")
+	}
+}
+
+func TestWriteCacheFlushesVerifiedPieces(t *testing.T) {
+	data := make([]byte, 3*32768)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+	under := &countingStorage{memoryStorage: newMemoryStorage(info, nil)}
+	st := newPieceStore(info, newCachedStorage(info, under, 1<<20, 1<<20))
+
+	// a verified piece is on the disk without waiting for a sync
+	_, err := st.writePiece(1, data[32768:2*32768])
+	if err != nil {
+		t.Fatalf("could not write the piece: %s", err)
+	}
+	if len(under.writes) != 1 || !bytes.Equal(under.data[32768:2*32768], data[32768:2*32768]) {
+		t.Fatalf("expected the piece to reach the storage, got=%v", under.writes)
+	}
+
+	// and peers asking for it don't have to go to the disk
+	st.readBlock(1, 0, 100)
+	if under.reads != 0 {
+		t.Fatalf("expected the piece to be read from the cache, got=%d reads", under.reads)
+	}
+}
+
+func TestWriteCacheLimit(t *testing.T) {
+	data := make([]byte, 4*32768)
+	info := testTorrent(data, 32768)
+	under := &countingStorage{memoryStorage: newMemoryStorage(info, nil)}
+	cs := newCachedStorage(info, under, 2*32768, 0)
+
+	// half pieces stay in the cache until there are too many of them
+	for index := 0; index < 3; index++ {
+		cs.WriteAt(data[index*32768:index*32768+MAXBLOCKSIZE], index, 0)
+	}
+	if len(under.writes) != 3 || cs.dirtySize != 0 {
+		t.Fatalf("expected a full cache to be flushed, got=%v", under.writes)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	data := make([]byte, 4*32768)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+	under := &countingStorage{memoryStorage: newMemoryStorage(info, data)}
+	cs := newCachedStorage(info, under, 0, 2*32768)
+
+	block := make([]byte, MAXBLOCKSIZE)
+	read := func(index, begin int) {
+		_, err := cs.ReadAt(block, index, begin)
+		if err != nil || !bytes.Equal(block, data[index*32768+begin:index*32768+begin+MAXBLOCKSIZE]) {
+			t.Fatalf("expected block %d of piece %d, got err=%v", begin, index, err)
+		}
+	}
+
+	read(0, 0)
+	read(0, MAXBLOCKSIZE)
+	read(1, 0)
+	read(0, 0)
+	read(2, 0) // pushes out piece 1, the least recently used
+	read(1, 0)
+
+	stats := cs.currentStats()
+	if stats.readHits != 2 || stats.readMisses != 4 || under.reads != 4 {
+		t.Fatalf("expected 2 hits and 4 misses, got=%+v with %d reads", stats, under.reads)
+	}
+
+	// a write replaces what the read cache had
+	cs.WriteAt(make([]byte, 32768), 1, 0)
+	cs.ReadAt(block, 1, 0)
+	if !bytes.Equal(block, make([]byte, MAXBLOCKSIZE)) {
+		t.Fatalf("expected the read cache to drop the overwritten piece")
+	}
+}
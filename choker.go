@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	UPLOADSLOTS        = 4                // peers we upload to at once, one of them optimistically
+	RECHOKEINTERVAL    = 10 * time.Second // how often the unchoked peers are picked again
+	OPTIMISTICINTERVAL = 30 * time.Second // how often the optimistic unchoke moves on
+	SNUBTIMEOUT        = time.Minute      // a peer that sent nothing for this long is snubbing us
+)
+
+// choker decides which peers we upload to. The peers that give us the most,
+// or take the most from us once we are seeding, get the upload slots, and one
+// more slot rotates between the rest so new peers get a chance to prove
+// themselves.
+type choker struct {
+	mu             sync.Mutex
+	config         Config
+	store          *pieceStore
+	peers          map[*client]*chokeState
+	optimistic     *client
+	lastOptimistic time.Time
+}
+
+type chokeState struct {
+	joined   time.Time
+	lastDown int // the peer's byte counters at the last rechoke
+	lastUp   int
+}
+
+type chokeCandidate struct {
+	c          *client
+	rate       int
+	interested bool
+	snubbed    bool
+}
+
+func newChoker(config Config, st *pieceStore) *choker {
+	return &choker{
+		config: config,
+		store:  st,
+		peers:  make(map[*client]*chokeState),
+	}
+}
+
+func (ch *choker) add(c *client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.peers[c] = &chokeState{joined: time.Now()}
+}
+
+func (ch *choker) remove(c *client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	delete(ch.peers, c)
+	if ch.optimistic == c {
+		ch.optimistic = nil
+	}
+}
+
+// clients returns the peers the choker knows, which is every live
+// connection of the session.
+func (ch *choker) clients() []*client {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	clients := make([]*client, 0, len(ch.peers))
+	for c := range ch.peers {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+// run rechokes every rechoke interval until done is closed.
+func (ch *choker) run(done <-chan struct{}) {
+	ticker := time.NewTicker(ch.config.rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ch.rechoke(time.Now())
+		}
+	}
+}
+
+func (ch *choker) rechoke(now time.Time) {
+	ch.mu.Lock()
+
+	seeding := ch.store.complete()
+	candidates := make([]chokeCandidate, 0, len(ch.peers))
+	for c, cs := range ch.peers {
+		c.mu.Lock()
+		down, up := c.downloaded, c.uploaded
+		cand := chokeCandidate{
+			c:          c,
+			interested: c.peerInterested,
+			// anti-snubbing, a peer we want pieces from that sends us nothing
+			// only gets the optimistic slot
+			snubbed: !seeding && c.interested && now.Sub(c.lastPiece) > ch.config.snubTimeout,
+		}
+		c.mu.Unlock()
+
+		// leeching we reward the peers we download from the fastest, seeding
+		// the ones that take our data the fastest
+		if seeding {
+			cand.rate = up - cs.lastUp
+		} else {
+			cand.rate = down - cs.lastDown
+		}
+		cs.lastDown, cs.lastUp = down, up
+
+		candidates = append(candidates, cand)
+	}
+
+	regular := 0
+	if ch.config.uploadSlots > 1 {
+		regular = ch.config.uploadSlots - 1
+	}
+	unchoke := make(map[*client]bool)
+	for _, c := range pickUnchoked(candidates, regular) {
+		unchoke[c] = true
+	}
+
+	if ch.config.uploadSlots > 0 {
+		if ch.optimistic == nil || unchoke[ch.optimistic] || now.Sub(ch.lastOptimistic) >= ch.config.optimisticInterval {
+			ch.optimistic = ch.pickOptimistic(candidates, unchoke, now)
+			ch.lastOptimistic = now
+		}
+		if ch.optimistic != nil {
+			unchoke[ch.optimistic] = true
+		}
+	}
+
+	ch.mu.Unlock()
+
+	// writing can block on a slow peer, so it happens outside the lock
+	for _, cand := range candidates {
+		if unchoke[cand.c] {
+			if cand.c.isChoking() {
+				cand.c.sendUnchoke()
+			}
+		} else if !cand.c.isChoking() {
+			cand.c.sendChoke()
+		}
+	}
+}
+
+// pickUnchoked returns the slots interested peers with the best rates,
+// snubbing peers are left out.
+func pickUnchoked(candidates []chokeCandidate, slots int) []*client {
+	eligible := []chokeCandidate{}
+	for _, cand := range candidates {
+		if cand.interested && !cand.snubbed {
+			eligible = append(eligible, cand)
+		}
+	}
+
+	sort.SliceStable(eligible, func(i, j int) bool {
+		return eligible[i].rate > eligible[j].rate
+	})
+
+	if len(eligible) > slots {
+		eligible = eligible[:slots]
+	}
+
+	unchoked := make([]*client, 0, len(eligible))
+	for _, cand := range eligible {
+		unchoked = append(unchoked, cand.c)
+	}
+
+	return unchoked
+}
+
+// pickOptimistic picks a random interested peer that isn't unchoked already,
+// peers that just connected are three times as likely to get picked since
+// they have nothing to offer yet.
+func (ch *choker) pickOptimistic(candidates []chokeCandidate, unchoked map[*client]bool, now time.Time) *client {
+	pool := []*client{}
+	for _, cand := range candidates {
+		if !cand.interested || unchoked[cand.c] {
+			continue
+		}
+
+		pool = append(pool, cand.c)
+		if now.Sub(ch.peers[cand.c].joined) < ch.config.optimisticInterval {
+			pool = append(pool, cand.c, cand.c)
+		}
+	}
+
+	if len(pool) == 0 {
+		return nil
+	}
+
+	return pool[rand.Intn(len(pool))]
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPickUnchoked(t *testing.T) {
+	a, b, c, d := &client{}, &client{}, &client{}, &client{}
+
+	got := pickUnchoked([]chokeCandidate{
+		{c: a, rate: 10, interested: true},
+		{c: b, rate: 50, interested: true, snubbed: true},
+		{c: c, rate: 30, interested: true},
+		{c: d, rate: 90, interested: false},
+	}, 2)
+
+	if len(got) != 2 || got[0] != c || got[1] != a {
+		t.Fatalf("expected the two fastest interested peers that don't snub us, got=%v", got)
+	}
+}
+
+// chokerPeer is a client whose messages are thrown away.
+func chokerPeer(t *testing.T, st *pieceStore) *client {
+	ours, theirs := net.Pipe()
+	go io.Copy(io.Discard, theirs)
+	t.Cleanup(func() { ours.Close(); theirs.Close() })
+
+	return &client{
+		conn:           ours,
+		store:          st,
+		choking:        true,
+		peerInterested: true,
+		lastPiece:      time.Now(),
+		done:           make(chan struct{}),
+		uploadReady:    make(chan struct{}, 1),
+	}
+}
+
+func TestRechokeSeeding(t *testing.T) {
+	data := bytes.Repeat([]byte("seed"), 10000)
+	info := testTorrent(data, 16384)
+	st, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+
+	config := defaultConfig()
+	config.uploadSlots = 2
+	ch := newChoker(config, st)
+
+	peers := []*client{}
+	for i := 0; i < 4; i++ {
+		c := chokerPeer(t, st)
+		c.uploaded = i * 1000
+		ch.add(c)
+		peers = append(peers, c)
+	}
+
+	ch.rechoke(time.Now())
+
+	// seeding the peer taking the most gets the regular slot, one of the
+	// others the optimistic one
+	unchoked := 0
+	for _, c := range peers {
+		if !c.isChoking() {
+			unchoked++
+		}
+	}
+	if unchoked != 2 {
+		t.Fatalf("expected 2 unchoked peers, got=%d", unchoked)
+	}
+	if peers[3].isChoking() {
+		t.Fatalf("expected the fastest peer to be unchoked")
+	}
+	if ch.optimistic == nil || ch.optimistic == peers[3] {
+		t.Fatalf("expected an optimistic unchoke besides the fastest peer")
+	}
+}
+
+func TestSetChoker(t *testing.T) {
+	tr := &Torrent{config: defaultConfig()}
+
+	err := tr.SetChoker(time.Second, 3*time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatalf("could not set the choker: %s", err)
+	}
+	if tr.config.rechokeInterval != time.Second || tr.config.optimisticInterval != 3*time.Second || tr.config.snubTimeout != 5*time.Second {
+		t.Fatalf("expected the choker settings to change, got=%v %v %v", tr.config.rechokeInterval, tr.config.optimisticInterval, tr.config.snubTimeout)
+	}
+
+	// a ticker can't run at 0
+	err = tr.SetChoker(0, time.Second, time.Second)
+	if err == nil || tr.config.rechokeInterval != time.Second {
+		t.Fatalf("expected a zero interval to be refused")
+	}
+}
@@ -5,54 +5,234 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type client struct {
 	conn       net.Conn
 	choked     bool
-	interested bool
 	bitfield   Bitfield
 	peer       Peer
 	infoHash   [20]byte
 	peerID     [20]byte
+	extended   bool // the peer set the extension protocol bit in its handshake
+	fast       bool // both of us speak the fast extension
+	extensions *extensionRegistry
+	store      *pieceStore   // where we serve requests from, nil while fetching metadata
+	done       chan struct{} // closed when the connection is closed
+	incoming   chan *Message // the peer's messages once readLoop runs
+	picker     *picker       // hears about the pieces the peer gets
+	stats      *transferStats
+
+	wmu sync.Mutex // serializes writes, the pex loop writes next to the worker
+
+	mu             sync.Mutex
+	peerExtensions map[string]int // the peer's extension message ids from its m dict
+	peerVersion    string
+	peerReqq       int
+	peerPort       int
+	yourIP         net.IP // our own address as the peer sees it
+	readErr        error  // why readLoop stopped
+	pex            *pexState
+
+	// upload state, the peer's requests wait in uploads until the upload
+	// loop gets to them
+	choking        bool // we are choking the peer
+	peerInterested bool
+	uploads        []blockRequest
+	uploadReady    chan struct{}
+
+	// what the choker looks at
+	interested bool      // we are interested in the peer
+	downloaded int       // bytes of blocks the peer sent us
+	uploaded   int       // bytes of blocks we sent the peer
+	lastPiece  time.Time // when the peer last sent us a block
+
+	// fast extension state, only touched by the worker of the connection
+	suggested      map[int]bool // pieces the peer suggested we get from it
+	allowedFast    map[int]bool // pieces the peer lets us get while choked
+	allowedFastOut map[int]bool // pieces we let the peer get while choked
 }
 
-func newClient(peer Peer, peerID, infoHash [20]byte) (*client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+func newClient(peer Peer, peerID, infoHash [20]byte, st *pieceStore, extensions *extensionRegistry, policy encryptionPolicy) (*client, error) {
+	conn, err := dialPeer(peer, infoHash, policy)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	h, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bf, err := getBitfield(conn)
+	return setupClient(conn, h, peer, peerID, infoHash, st, extensions)
+}
+
+// acceptClient sets up a connection a peer opened to us.
+func acceptClient(conn net.Conn, peerID, infoHash [20]byte, st *pieceStore, extensions *extensionRegistry, policy encryptionPolicy) (*client, error) {
+	conn, err := acceptPeer(conn, [][20]byte{infoHash}, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := answerHandshake(conn, infoHash, peerID)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
+	// the peer can come in over tcp or utp
+	_, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	peer := Peer{IP: remoteIP(conn.RemoteAddr()), Port: uint16(p)}
+
+	return setupClient(conn, h, peer, peerID, infoHash, st, extensions)
+}
+
+func setupClient(conn net.Conn, h *handshake, peer Peer, peerID, infoHash [20]byte, st *pieceStore, extensions *extensionRegistry) (*client, error) {
+	var err error
+
+	// before we have the metadata we don't know how many pieces there are
+	numPieces := 0
+	have := Bitfield{}
+	if st != nil {
+		numPieces = len(st.info.pieces)
+		have = st.bitfield()
+	}
+
 	c := &client{
-		conn:       conn,
-		choked:     true,
-		interested: false,
-		bitfield:   bf,
-		peer:       peer,
-		infoHash:   infoHash,
-		peerID:     peerID,
+		conn:           conn,
+		choked:         true,
+		peer:           peer,
+		infoHash:       infoHash,
+		peerID:         peerID,
+		extended:       h.supportsExtensions(),
+		fast:           h.supportsFast(),
+		extensions:     extensions,
+		store:          st,
+		done:           make(chan struct{}),
+		incoming:       make(chan *Message, 16),
+		choking:        true,
+		uploadReady:    make(chan struct{}, 1),
+		lastPiece:      time.Now(),
+		suggested:      make(map[int]bool),
+		allowedFast:    make(map[int]bool),
+		allowedFastOut: make(map[int]bool),
+	}
+
+	err = c.sendHaves(have, numPieces)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var fastSet []int
+	if c.fast {
+		fastSet = allowedFastSet(peer.IP, infoHash, numPieces, ALLOWEDFASTSIZE)
+		for _, index := range fastSet {
+			c.allowedFastOut[index] = true
+		}
+	}
+
+	bf, err := getBitfield(conn, numPieces, c.fast)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.bitfield = bf
+
+	// the pieces of the set we already have can be asked for right away, the
+	// others are announced once we get them
+	if !isSeed(bf, numPieces) {
+		for _, index := range fastSet {
+			if !have.HasPiece(index) {
+				continue
+			}
+
+			err = c.sendAllowedFast(index)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
 	}
 
 	return c, nil
 }
 
+func (c *client) close() {
+	c.conn.Close()
+	close(c.done)
+}
+
+// prefers reports whether the peer pointed us at the piece, by suggesting it
+// or letting us have it while we are choked.
+func (c *client) prefers(index int) bool {
+	return c.suggested[index] || (c.choked && c.allowedFast[index])
+}
+
+// maxBacklog is the number of requests we keep queued with the peer, never
+// more than the peer said it can handle.
+func (c *client) maxBacklog() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peerReqq > 0 && c.peerReqq < MAXBACKLOG {
+		return c.peerReqq
+	}
+
+	return MAXBACKLOG
+}
+
 func (c *client) read() (*Message, error) {
 	return readMessage(c.conn)
 }
 
+// readLoop reads the peer's messages into incoming, so the worker can wait on
+// them next to other things. It closes incoming when the connection fails.
+func (c *client) readLoop() {
+	defer close(c.incoming)
+
+	for {
+		msg, err := readMessage(c.conn)
+		if err != nil {
+			c.mu.Lock()
+			c.readErr = err
+			c.mu.Unlock()
+			return
+		}
+
+		select {
+		case c.incoming <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) readError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readErr
+}
+
+func (c *client) write(buf []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
 func completeHandshake(conn net.Conn, infoHash, id [20]byte) (*handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // disable the deadline
@@ -73,7 +253,30 @@ func completeHandshake(conn net.Conn, infoHash, id [20]byte) (*handshake, error)
 	return res, nil
 }
 
-func getBitfield(conn net.Conn) (Bitfield, error) {
+// answerHandshake is completeHandshake for connections the peer opened, we
+// wait for its handshake and answer if it is for our torrent.
+func answerHandshake(conn net.Conn, infoHash, id [20]byte) (*handshake, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	res, err := deserializeHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.infoHash[:], infoHash[:]) {
+		return nil, errors.New("the peer asked for a torrent we don't have")
+	}
+
+	req := newHandshake(infoHash, id)
+	_, err = conn.Write(req.serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func getBitfield(conn net.Conn, numPieces int, fast bool) (Bitfield, error) {
 	msg, err := readMessage(conn)
 	if err != nil {
 		return nil, err
@@ -83,6 +286,16 @@ func getBitfield(conn net.Conn) (Bitfield, error) {
 		return nil, errors.New("expected a bitfield message")
 	}
 
+	// with the fast extension have all and have none can stand in for it
+	if fast {
+		switch msg.ID {
+		case MsgHaveAll:
+			return fullBitfield(numPieces), nil
+		case MsgHaveNone:
+			return newBitfield(numPieces), nil
+		}
+	}
+
 	if msg.ID != MsgBitfield {
 		return nil, errors.New("expected msg to be of type bitfield")
 	}
@@ -90,6 +303,29 @@ func getBitfield(conn net.Conn) (Bitfield, error) {
 	return msg.Payload, nil
 }
 
+// sendHaves tells the peer which pieces we have, right after the handshake.
+func (c *client) sendHaves(have Bitfield, numPieces int) error {
+	// the fast extension wants us to say what we have before anything else,
+	// and has shorter messages for having all or nothing
+	if c.fast {
+		switch {
+		case numPieces > 0 && isSeed(have, numPieces):
+			msg := Message{ID: MsgHaveAll}
+			return c.write(msg.serialize())
+		case have.Empty():
+			return c.sendHaveNone()
+		}
+	}
+
+	// without it an empty bitfield can be left out
+	if have.Empty() {
+		return nil
+	}
+
+	msg := Message{ID: MsgBitfield, Payload: have}
+	return c.write(msg.serialize())
+}
+
 func (c *client) sendHave(index int) {
 	msg := make([]byte, 9)
 
@@ -97,19 +333,25 @@ func (c *client) sendHave(index int) {
 	msg[4] = 4
 	binary.BigEndian.PutUint32(msg[5:], uint32(index))
 
-	c.conn.Write(msg)
+	c.write(msg)
 }
 
 func (c *client) sendUnchoke() error {
+	c.mu.Lock()
+	c.choking = false
+	c.mu.Unlock()
+
 	msg := Message{ID: MsgUnchoke}
-	_, err := c.conn.Write(msg.serialize())
-	return err
+	return c.write(msg.serialize())
 }
 
 func (c *client) sendInterested() error {
+	c.mu.Lock()
+	c.interested = true
+	c.mu.Unlock()
+
 	msg := Message{ID: MsgInterested}
-	_, err := c.conn.Write(msg.serialize())
-	return err
+	return c.write(msg.serialize())
 }
 
 func (c *client) sendRequest(pieceIdx, begin, blocksize int) error {
@@ -120,10 +362,21 @@ func (c *client) sendRequest(pieceIdx, begin, blocksize int) error {
 	binary.BigEndian.PutUint32(msg[9:13], uint32(begin))
 	binary.BigEndian.PutUint32(msg[13:], uint32(blocksize))
 
-	_, err := c.conn.Write(msg)
+	err := c.write(msg)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (c *client) sendCancel(pieceIdx, begin, blocksize int) error {
+	msg := make([]byte, 13+4)
+	binary.BigEndian.PutUint32(msg[:4], 13)
+	msg[4] = byte(MsgCancel)
+	binary.BigEndian.PutUint32(msg[5:9], uint32(pieceIdx))
+	binary.BigEndian.PutUint32(msg[9:13], uint32(begin))
+	binary.BigEndian.PutUint32(msg[13:], uint32(blocksize))
+
+	return c.write(msg)
+}
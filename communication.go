@@ -3,9 +3,9 @@ package main
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/Laseruss/bittorrent-client/bencode"
 )
@@ -16,13 +16,33 @@ type Peer struct {
 }
 
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 type Peers []Peer
 
+// getPeers asks the trackers of the torrent for peers in order and returns
+// the answer of the first one that responds.
 func getPeers(t *Torrent) (Peers, error) {
-	url, err := t.buildTrackerURL()
+	err := errors.New("the torrent has no trackers")
+
+	for _, announce := range append([]string{t.announce}, t.announceList...) {
+		if announce == "" {
+			continue
+		}
+
+		var peers Peers
+		peers, err = announceTo(t, announce)
+		if err == nil {
+			return peers, nil
+		}
+	}
+
+	return nil, err
+}
+
+func announceTo(t *Torrent, announce string) (Peers, error) {
+	url, err := t.buildTrackerURL(announce)
 	if err != nil {
 		return nil, err
 	}
@@ -78,3 +98,45 @@ func deserializePeers(data []byte) (Peers, error) {
 
 	return peers, nil
 }
+
+func deserializePeers6(data []byte) (Peers, error) {
+	const peerSize = 18
+	if len(data)%peerSize != 0 {
+		return nil, errors.New("got malformed ipv6 peers info")
+	}
+	numPeers := len(data) / peerSize
+
+	peers := make(Peers, 0, numPeers)
+
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peer := Peer{}
+		peer.IP = net.IP(data[offset : offset+16])
+		peer.Port = binary.BigEndian.Uint16(data[offset+16 : offset+18])
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// serializePeers writes the compact form of the peers, ipv4 peers go in the
+// first slice and ipv6 peers in the second.
+func serializePeers(peers Peers) ([]byte, []byte) {
+	var v4, v6 []byte
+
+	for _, peer := range peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, peer.Port)
+
+		if ip := peer.IP.To4(); ip != nil {
+			v4 = append(v4, ip...)
+			v4 = append(v4, port...)
+		} else {
+			v6 = append(v6, peer.IP.To16()...)
+			v6 = append(v6, port...)
+		}
+	}
+
+	return v4, v6
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config holds the settings of a single torrent, start from defaultConfig.
+type Config struct {
+	encryption encryptionPolicy
+
+	// the choker
+	uploadSlots        int // 0 turns uploading off
+	rechokeInterval    time.Duration
+	optimisticInterval time.Duration
+	snubTimeout        time.Duration
+
+	picker PiecePicker
+
+	dir        string // the files of the torrent go under it
+	storage    StorageOpener
+	allocation allocationMode
+	writeCache int // bytes, 0 writes every piece out right away
+	readCache  int // bytes, 0 reads every block from the storage
+}
+
+func defaultConfig() Config {
+	return Config{
+		encryption:         encryptionPreferred,
+		uploadSlots:        UPLOADSLOTS,
+		rechokeInterval:    RECHOKEINTERVAL,
+		optimisticInterval: OPTIMISTICINTERVAL,
+		snubTimeout:        SNUBTIMEOUT,
+		picker:             RarestFirst{},
+		dir:                ".",
+		storage:            openFileStorage,
+		allocation:         allocateSparse,
+		writeCache:         WRITECACHESIZE,
+		readCache:          READCACHESIZE,
+	}
+}
+
+// SetPiecePicker changes the order the pieces of the torrent are downloaded
+// in, it has to be called before the download starts.
+func (t *Torrent) SetPiecePicker(p PiecePicker) {
+	t.config.picker = p
+}
+
+// SetStorage changes where the content of the torrent is kept, the files go
+// under dir. It has to be called before the download starts.
+func (t *Torrent) SetStorage(dir string, open StorageOpener) {
+	t.config.dir = dir
+	t.config.storage = open
+}
+
+// SetAllocation changes how the files of the torrent take up disk space, it
+// has to be called before the download starts.
+func (t *Torrent) SetAllocation(mode allocationMode) {
+	t.config.allocation = mode
+}
+
+// SetChoker changes how often the peers we upload to are picked again, how
+// often the optimistic unchoke moves on and how long a peer can send us
+// nothing before it counts as snubbing us. It has to be called before the
+// download starts.
+func (t *Torrent) SetChoker(rechoke, optimistic, snub time.Duration) error {
+	if rechoke <= 0 || optimistic <= 0 || snub <= 0 {
+		return errors.New("the choker intervals have to be positive")
+	}
+
+	t.config.rechokeInterval = rechoke
+	t.config.optimisticInterval = optimistic
+	t.config.snubTimeout = snub
+
+	return nil
+}
+
+type encryptionPolicy int
+
+const (
+	encryptionDisabled  encryptionPolicy = iota // plaintext connections only
+	encryptionPreferred                         // try encrypting, fall back to plaintext
+	encryptionRequired                          // drop peers that won't encrypt
+)
+
+func parseEncryptionPolicy(s string) (encryptionPolicy, error) {
+	switch s {
+	case "disabled":
+		return encryptionDisabled, nil
+	case "preferred":
+		return encryptionPreferred, nil
+	case "required":
+		return encryptionRequired, nil
+	}
+
+	return 0, fmt.Errorf("unknown encryption policy %q, expected disabled, preferred or required", s)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+// extHandshake is the extended message id reserved for the extended handshake
+const extHandshake uint8 = 0
+
+const (
+	CLIENTVERSION = "bittorrent-client-go 0.1"
+	MAXREQQ       = 250 // outstanding requests we let a peer queue up with us
+)
+
+// extensionHandler is how a single extension plugs into the extension
+// protocol. The registry gives it a local id that peers use when they send us
+// its messages.
+type extensionHandler struct {
+	name string
+	// handshake is called when the peer's extended handshake arrives, can be nil
+	handshake func(c *client, hs *extendedHandshake) error
+	// handle is called with the payload of every message sent for the extension
+	handle func(c *client, payload []byte) error
+}
+
+type extensionRegistry struct {
+	handlers []*extensionHandler // the local id of a handler is its index + 1
+	extra    bencode.Dictionary  // keys extensions want in our handshake
+}
+
+func newExtensionRegistry() *extensionRegistry {
+	return &extensionRegistry{
+		extra: bencode.Dictionary{},
+	}
+}
+
+func (r *extensionRegistry) register(h *extensionHandler) uint8 {
+	r.handlers = append(r.handlers, h)
+	return uint8(len(r.handlers))
+}
+
+func (r *extensionRegistry) lookup(id uint8) *extensionHandler {
+	if id == extHandshake || int(id) > len(r.handlers) {
+		return nil
+	}
+
+	return r.handlers[id-1]
+}
+
+// extendedHandshake holds the fields of a BEP 10 handshake we care about, the
+// full dictionary is kept for extensions that define their own keys.
+type extendedHandshake struct {
+	m      map[string]int
+	v      string
+	reqq   int
+	yourip net.IP
+	p      int
+	dict   bencode.Dictionary
+}
+
+func parseExtendedHandshake(dict bencode.Dictionary) (*extendedHandshake, error) {
+	m, ok := dict["m"].(bencode.Dictionary)
+	if !ok {
+		return nil, errors.New("expected m in the extended handshake to be a dictionary")
+	}
+
+	hs := &extendedHandshake{
+		m:    make(map[string]int),
+		dict: dict,
+	}
+
+	for name, val := range m {
+		id, ok := val.(int)
+		if !ok || id < 0 || id > 255 {
+			continue
+		}
+		hs.m[name] = id
+	}
+
+	if v, ok := dict["v"].([]byte); ok {
+		hs.v = string(v)
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		hs.reqq = reqq
+	}
+	if ip, ok := dict["yourip"].([]byte); ok && (len(ip) == 4 || len(ip) == 16) {
+		hs.yourip = net.IP(ip)
+	}
+	if p, ok := dict["p"].(int); ok && p > 0 && p <= 65535 {
+		hs.p = p
+	}
+
+	return hs, nil
+}
+
+func decodeDict(data []byte) (bencode.Dictionary, error) {
+	dec := bencode.NewDecoder(bytes.NewReader(data))
+	val, err := dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := val.(bencode.Dictionary)
+	if !ok {
+		return nil, errors.New("expected extended message to be a dictionary")
+	}
+
+	return dict, nil
+}
+
+// remoteIP returns the ip of the other end of the connection in its compact
+// form, 4 bytes for ipv4 and 16 for ipv6.
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func (c *client) sendExtended(id uint8, dict bencode.Dictionary) error {
+	data, err := bencode.Encode(dict)
+	if err != nil {
+		return err
+	}
+
+	return c.sendExtendedRaw(id, data)
+}
+
+// sendExtendedRaw sends an already encoded extension message, for extensions
+// that put raw data after the dictionary.
+func (c *client) sendExtendedRaw(id uint8, data []byte) error {
+	msg := Message{ID: MsgExtended, Payload: append([]byte{id}, data...)}
+	return c.write(msg.serialize())
+}
+
+func (c *client) sendExtendedHandshake() error {
+	m := bencode.Dictionary{}
+	for i, h := range c.extensions.handlers {
+		m[h.name] = i + 1
+	}
+
+	hs := bencode.Dictionary{
+		"m":    m,
+		"v":    CLIENTVERSION,
+		"reqq": MAXREQQ,
+		"p":    PORT,
+	}
+	if ip := remoteIP(c.conn.RemoteAddr()); ip != nil {
+		hs["yourip"] = []byte(ip)
+	}
+	for k, v := range c.extensions.extra {
+		hs[k] = v
+	}
+
+	return c.sendExtended(extHandshake, hs)
+}
+
+// extensionID returns the id the peer wants for the named extension, or 0
+// when the peer does not support it.
+func (c *client) extensionID(name string) uint8 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return uint8(c.peerExtensions[name])
+}
+
+func (c *client) handleExtended(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("the extended message was to short")
+	}
+
+	if payload[0] == extHandshake {
+		dict, err := decodeDict(payload[1:])
+		if err != nil {
+			return err
+		}
+
+		return c.handleExtendedHandshake(dict)
+	}
+
+	h := c.extensions.lookup(payload[0])
+	if h == nil {
+		return nil // not an id we handed out, ignore it
+	}
+
+	return h.handle(c, payload[1:])
+}
+
+func (c *client) handleExtendedHandshake(dict bencode.Dictionary) error {
+	hs, err := parseExtendedHandshake(dict)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.peerExtensions == nil {
+		c.peerExtensions = make(map[string]int)
+	}
+	// later handshakes only update the extensions they mention, and an id of
+	// 0 means the peer turned the extension off
+	for name, id := range hs.m {
+		if id == 0 {
+			delete(c.peerExtensions, name)
+			continue
+		}
+		c.peerExtensions[name] = id
+	}
+	if hs.v != "" {
+		c.peerVersion = hs.v
+	}
+	if hs.reqq != 0 {
+		c.peerReqq = hs.reqq
+	}
+	if hs.p != 0 {
+		c.peerPort = hs.p
+	}
+	if hs.yourip != nil {
+		c.yourIP = hs.yourip
+	}
+	c.mu.Unlock()
+
+	for _, h := range c.extensions.handlers {
+		if h.handshake == nil {
+			continue
+		}
+
+		err := h.handshake(c, hs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
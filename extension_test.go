@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+func TestHandshakeReservedBits(t *testing.T) {
+	h := newHandshake([20]byte{1}, [20]byte{2})
+
+	got, err := deserializeHandshake(bytes.NewReader(h.serialize()))
+	if err != nil {
+		t.Fatalf("could not deserialize handshake: %s", err)
+	}
+
+	if got.reserved != h.reserved {
+		t.Fatalf("expected reserved bytes %v, got=%v", h.reserved, got.reserved)
+	}
+	if !got.supportsExtensions() {
+		t.Fatalf("expected the extension protocol bit to be set")
+	}
+}
+
+func TestExtendedHandshakeDispatch(t *testing.T) {
+	var handled []byte
+	registry := newExtensionRegistry()
+	id := registry.register(&extensionHandler{
+		name: "ut_test",
+		handle: func(c *client, payload []byte) error {
+			handled = payload
+			return nil
+		},
+	})
+
+	c := &client{extensions: registry}
+
+	hs, err := bencode.Encode(bencode.Dictionary{
+		"m":      bencode.Dictionary{"ut_test": 3, "ut_pex": 1},
+		"v":      "test 1.0",
+		"reqq":   2,
+		"p":      51413,
+		"yourip": []byte{10, 0, 0, 1},
+	})
+	if err != nil {
+		t.Fatalf("could not encode handshake: %s", err)
+	}
+
+	err = c.handleExtended(append([]byte{extHandshake}, hs...))
+	if err != nil {
+		t.Fatalf("could not handle handshake: %s", err)
+	}
+
+	if c.extensionID("ut_test") != 3 {
+		t.Fatalf("expected ut_test to have id 3, got=%d", c.extensionID("ut_test"))
+	}
+	if c.peerVersion != "test 1.0" || c.peerPort != 51413 || c.yourIP.String() != "10.0.0.1" {
+		t.Fatalf("got unexpected handshake fields %q %d %s", c.peerVersion, c.peerPort, c.yourIP)
+	}
+	if c.maxBacklog() != 2 {
+		t.Fatalf("expected the backlog to follow reqq, got=%d", c.maxBacklog())
+	}
+
+	err = c.handleExtended([]byte{id, 'h', 'i'})
+	if err != nil {
+		t.Fatalf("could not handle extension message: %s", err)
+	}
+	if string(handled) != "hi" {
+		t.Fatalf("expected handler to get hi, got=%q", handled)
+	}
+}
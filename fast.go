@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// ALLOWEDFASTSIZE is how many pieces a peer may get from us while choked
+const ALLOWEDFASTSIZE = 10
+
+// allowedFastSet is the canonical allowed fast set of BEP 6, derived from the
+// peer's ip so every client hands the same peer the same pieces.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil // only defined for ipv4
+	}
+
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := []int{}
+	seen := make(map[int]bool)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(numPieces))
+			if seen[index] {
+				continue
+			}
+			seen[index] = true
+			set = append(set, index)
+		}
+	}
+
+	return set
+}
+
+func parseIndex(payload []byte) (int, error) {
+	if len(payload) < 4 {
+		return 0, errors.New("the message was to short to hold a piece index")
+	}
+
+	return int(binary.BigEndian.Uint32(payload[:4])), nil
+}
+
+func (c *client) sendHaveNone() error {
+	msg := Message{ID: MsgHaveNone}
+	return c.write(msg.serialize())
+}
+
+func (c *client) sendAllowedFast(index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	msg := Message{ID: MsgAllowedFast, Payload: payload}
+	return c.write(msg.serialize())
+}
+
+// sendRejectRequest tells the peer we won't answer its request, the payload is
+// the index, begin and length of the request.
+func (c *client) sendRejectRequest(request []byte) error {
+	msg := Message{ID: MsgRejectRequest, Payload: request}
+	return c.write(msg.serialize())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	// the example from BEP 6
+	tests := []struct {
+		k        int
+		expected []int
+	}{
+		{k: 7, expected: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{k: 9, expected: []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+
+	for _, tt := range tests {
+		got := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 1313, tt.k)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("expected allowed fast set %v, got=%v", tt.expected, got)
+		}
+	}
+}
+
+func TestAllowedFastSentForPiecesWeHave(t *testing.T) {
+	info := testTorrent(make([]byte, 40*100), 100)
+	st := newPieceStore(info, newMemoryStorage(info, nil))
+	for index := 0; index < 40; index += 2 {
+		st.markPiece(index)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer ln.Close()
+	ours, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	defer ours.Close()
+	theirs, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("could not accept: %s", err)
+	}
+	defer theirs.Close()
+
+	peer := Peer{IP: net.IPv4(80, 4, 4, 200), Port: 6881}
+	haveNone := Message{ID: MsgHaveNone}
+	theirs.Write(haveNone.serialize())
+	_, err = setupClient(ours, newHandshake(info.infoHash, [20]byte{}), peer, [20]byte{}, info.infoHash, st, newExtensionRegistry())
+	if err != nil {
+		t.Fatalf("could not set up the client: %s", err)
+	}
+
+	expected := map[int]bool{}
+	for _, index := range allowedFastSet(peer.IP, info.infoHash, 40, ALLOWEDFASTSIZE) {
+		if index%2 == 0 {
+			expected[index] = true
+		}
+	}
+	if len(expected) == 0 {
+		t.Fatalf("expected some of the allowed fast set to be ours")
+	}
+
+	// our bitfield comes first, then the allowed fast pieces we have
+	if msg, err := readMessage(theirs); err != nil || msg.ID != MsgBitfield {
+		t.Fatalf("expected our bitfield, got=%v %v", msg, err)
+	}
+	for len(expected) > 0 {
+		theirs.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := readMessage(theirs)
+		if err != nil {
+			t.Fatalf("expected allowed fast for %v, got=%s", expected, err)
+		}
+		index, _ := parseIndex(msg.Payload)
+		if msg.ID != MsgAllowedFast || !expected[index] {
+			t.Fatalf("expected allowed fast for one of %v, got=%d %d", expected, msg.ID, index)
+		}
+		delete(expected, index)
+	}
+}
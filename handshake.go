@@ -7,6 +7,7 @@ import (
 
 type handshake struct {
 	pstr     string
+	reserved [8]byte
 	infoHash [20]byte
 	peerID   [20]byte
 }
@@ -14,11 +15,23 @@ type handshake struct {
 const PEER_STRING = "BitTorrent protocol"
 
 func newHandshake(infoHash, peerID [20]byte) *handshake {
-	return &handshake{
+	h := &handshake{
 		pstr:     PEER_STRING,
 		infoHash: infoHash,
 		peerID:   peerID,
 	}
+	h.reserved[5] |= 0x10 // bit 20, we speak the extension protocol (BEP 10)
+	h.reserved[7] |= 0x04 // bit 62, we speak the fast extension (BEP 6)
+
+	return h
+}
+
+func (h *handshake) supportsExtensions() bool {
+	return h.reserved[5]&0x10 != 0
+}
+
+func (h *handshake) supportsFast() bool {
+	return h.reserved[7]&0x04 != 0
 }
 
 func (h handshake) serialize() []byte {
@@ -26,7 +39,7 @@ func (h handshake) serialize() []byte {
 	buf[0] = 0x13 // len of pstr
 	curr := 1
 	curr += copy(buf[curr:], []byte(h.pstr))
-	curr += copy(buf[curr:], []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) // eight reserved bytes
+	curr += copy(buf[curr:], h.reserved[:]) // eight reserved bytes
 	curr += copy(buf[curr:], h.infoHash[:])
 	curr += copy(buf[curr:], h.peerID[:])
 
@@ -50,13 +63,16 @@ func deserializeHandshake(r io.Reader) (*handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[l:l+8])
 	copy(infoHash[:], handshakeBuf[l+8:l+8+20]) // start reading after pstr and 8 reserved bytes and 20 bytes for the infohash
 	copy(peerID[:], handshakeBuf[l+8+20:])      // start reading after infoHash and to the end to get the peerID
 
 	h := &handshake{
 		pstr:     string(handshakeBuf[0:l]),
+		reserved: reserved,
 		infoHash: infoHash,
 		peerID:   peerID,
 	}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// listenForPeers accepts the connections of peers that found us through the
+// tracker or other peers, over tcp and utp, and puts them to work like the
+// ones we dialed.
+func (sess *session) listenForPeers(done <-chan struct{}) {
+	go sess.acceptUTPPeers(done)
+
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(PORT))
+	if err != nil {
+		fmt.Println("could not listen for peers:", err)
+		return
+	}
+
+	go func() {
+		<-done
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // the listener was closed
+		}
+
+		go sess.handleIncoming(conn)
+	}
+}
+
+func (sess *session) acceptUTPPeers(done <-chan struct{}) {
+	s, err := sharedUTPSocket()
+	if err != nil {
+		fmt.Println("could not listen for utp peers:", err)
+		return
+	}
+
+	for {
+		conn, err := s.acceptConn(done)
+		if err != nil {
+			return
+		}
+
+		go sess.handleIncoming(conn)
+	}
+}
+
+func (sess *session) handleIncoming(conn net.Conn) {
+	// peers that connect to us count against the same limit as the ones we
+	// dial, when we are full they are turned away instead of waiting
+	s := sess.swarm
+	if !s.tryAcquire() {
+		conn.Close()
+		return
+	}
+	defer s.release()
+
+	t := sess.t
+	c, err := acceptClient(conn, t.peerID, t.info.infoHash, sess.store, sess.extensions, t.config.encryption)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer c.close()
+	fmt.Printf("Accepted connection from %s\n", c.peer.IP)
+
+	// the port is the one the peer connected from, we don't know if it takes
+	// connections itself so it isn't marked reachable
+	s.connect(c.peer, sess.peerFlags(c))
+	defer s.disconnect(c.peer)
+
+	sess.work(c)
+}
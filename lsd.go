@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local service discovery (BEP 14) multicast groups
+const (
+	LSDADDR4 = "239.192.152.143:6771"
+	LSDADDR6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	LSDINTERVAL = 5 * time.Minute // how often we announce ourselves
+	LSDMINGAP   = time.Minute     // announces from one host closer than this are dropped
+)
+
+type lsd struct {
+	infoHash [20]byte
+	port     int
+	cookie   string
+	swarm    *swarm
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newCookie() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// startLSD announces the torrent on the local network and hands every peer
+// that announces the same torrent to the swarm, until done is closed.
+func startLSD(t *Torrent, s *swarm, done <-chan struct{}) error {
+	cookie, err := newCookie()
+	if err != nil {
+		return err
+	}
+
+	l := &lsd{
+		infoHash: t.info.infoHash,
+		port:     PORT,
+		cookie:   cookie,
+		swarm:    s,
+		lastSeen: make(map[string]time.Time),
+	}
+
+	go l.run("udp4", LSDADDR4, done)
+	go l.run("udp6", LSDADDR6, done)
+
+	return nil
+}
+
+func (l *lsd) run(network, group string, done <-chan struct{}) {
+	addr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		fmt.Println("could not resolve the local discovery group", group, err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		fmt.Println("could not join the local discovery group", group, err)
+		return
+	}
+	defer conn.Close()
+
+	go l.listen(conn)
+
+	ticker := time.NewTicker(LSDINTERVAL)
+	defer ticker.Stop()
+
+	msg := buildLSDAnnounce(group, l.port, l.infoHash, l.cookie)
+	for {
+		// not fatal, the network might just not route multicast
+		_, err = conn.WriteToUDP(msg, addr)
+		if err != nil {
+			fmt.Println("could not announce on", group, err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *lsd) listen(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // the connection was closed
+		}
+
+		l.handle(buf[:n], src)
+	}
+}
+
+func (l *lsd) handle(buf []byte, src *net.UDPAddr) {
+	port, infoHashes, cookie, err := parseLSDAnnounce(buf)
+	if err != nil {
+		return
+	}
+
+	// our own announces come back to us over the multicast loopback
+	if cookie != "" && cookie == l.cookie {
+		return
+	}
+
+	want := hex.EncodeToString(l.infoHash[:])
+	found := false
+	for _, ih := range infoHashes {
+		if strings.EqualFold(ih, want) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+
+	l.mu.Lock()
+	last, ok := l.lastSeen[src.IP.String()]
+	if ok && time.Since(last) < LSDMINGAP {
+		l.mu.Unlock()
+		return
+	}
+	l.lastSeen[src.IP.String()] = time.Now()
+	l.mu.Unlock()
+
+	l.swarm.addPeer(Peer{IP: src.IP, Port: uint16(port)})
+}
+
+func buildLSDAnnounce(host string, port int, infoHash [20]byte, cookie string) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + host + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(port) + "\r\n")
+	buf.WriteString("Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n")
+	buf.WriteString("cookie: " + cookie + "\r\n")
+	buf.WriteString("\r\n\r\n")
+
+	return buf.Bytes()
+}
+
+func parseLSDAnnounce(buf []byte) (int, []string, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", errors.New("expected a BT-SEARCH announce")
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if port <= 0 || port > 65535 {
+		return 0, nil, "", errors.New("got an invalid port in the announce")
+	}
+
+	infoHashes := req.Header.Values("Infohash")
+	if len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("expected the announce to contain an infohash")
+	}
+
+	return port, infoHashes, req.Header.Get("Cookie"), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	msg := buildLSDAnnounce(LSDADDR4, 6881, infoHash, "abc123")
+
+	port, infoHashes, cookie, err := parseLSDAnnounce(msg)
+	if err != nil {
+		t.Fatalf("could not parse announce: %s", err)
+	}
+
+	if port != 6881 {
+		t.Fatalf("expected port to be 6881, got=%d", port)
+	}
+	if len(infoHashes) != 1 || infoHashes[0] != "deadbeef00000000000000000000000000000000" {
+		t.Fatalf("got unexpected infohashes %v", infoHashes)
+	}
+	if cookie != "abc123" {
+		t.Fatalf("expected cookie to be abc123, got=%s", cookie)
+	}
+}
+
+func TestLSDHandle(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	s := newSwarm()
+	l := &lsd{
+		infoHash: infoHash,
+		cookie:   "mine",
+		swarm:    s,
+		lastSeen: make(map[string]time.Time),
+	}
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 6771}
+
+	// our own announce looped back
+	l.handle(buildLSDAnnounce(LSDADDR4, 6881, infoHash, "mine"), src)
+	// an announce for some other torrent
+	l.handle(buildLSDAnnounce(LSDADDR4, 6881, [20]byte{9}, "theirs"), src)
+	if len(s.newPeers) != 0 {
+		t.Fatalf("expected no peers to be added, got=%d", len(s.newPeers))
+	}
+
+	l.handle(buildLSDAnnounce(LSDADDR4, 51413, infoHash, "theirs"), src)
+	// the second one comes too soon after the first
+	l.handle(buildLSDAnnounce(LSDADDR4, 51414, infoHash, "theirs"), src)
+	if len(s.newPeers) != 1 {
+		t.Fatalf("expected one peer to be added, got=%d", len(s.newPeers))
+	}
+
+	peer := <-s.newPeers
+	if peer.String() != "192.168.1.20:51413" {
+		t.Fatalf("expected peer 192.168.1.20:51413, got=%s", peer)
+	}
+}
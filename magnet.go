@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type magnet struct {
+	infoHash [20]byte
+	name     string
+	trackers []string
+	peers    Peers
+	webSeeds []string
+}
+
+func parseMagnet(uri string) (*magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, errors.New("expected the link to start with magnet:")
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &magnet{}
+
+	found := false
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue // some other kind of hash, like btmh for v2 torrents
+		}
+
+		m.infoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, errors.New("expected the magnet link to contain a urn:btih info hash")
+	}
+
+	m.name = params.Get("dn")
+	m.trackers = params["tr"]
+	m.webSeeds = params["ws"]
+
+	for _, pe := range params["x.pe"] {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			continue // a bad peer shouldn't stop the download
+		}
+
+		m.peers = append(m.peers, Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+
+	return m, nil
+}
+
+// parseInfoHash accepts both the 40 character hex and the 32 character
+// base32 forms of an info hash.
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, errors.New("expected the info hash to be 40 hex or 32 base32 characters")
+	}
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], b)
+
+	return infoHash, nil
+}
+
+// newTorrentFromMagnet builds a torrent without an info dict, it has to be
+// fetched from peers with fetchMetadata before the download can start.
+func newTorrentFromMagnet(uri string) (*Torrent, error) {
+	m, err := parseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := &Torrent{
+		config: defaultConfig(),
+		peers:  m.peers,
+		info: &TorrentFile{
+			name:     m.name,
+			infoHash: m.infoHash,
+		},
+	}
+
+	if len(m.trackers) > 0 {
+		torrent.announce = m.trackers[0]
+		torrent.announceList = m.trackers[1:]
+	}
+
+	id, err := createPeerId()
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.peerID = id
+
+	return torrent, nil
+}
+
+func (t *Torrent) hasMetadata() bool {
+	return len(t.info.pieces) > 0
+}
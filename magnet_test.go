@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	expected, _ := hex.DecodeString(hexHash)
+
+	tests := []string{
+		"magnet:?xt=urn:btih:" + hexHash + "&dn=debian.iso&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Fother.example%3A80&x.pe=10.0.0.2%3A6881&ws=http%3A%2F%2Fseed.example%2Fdebian.iso",
+		"magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK&dn=debian.iso&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Fother.example%3A80&x.pe=10.0.0.2%3A6881&ws=http%3A%2F%2Fseed.example%2Fdebian.iso",
+	}
+
+	for _, uri := range tests {
+		m, err := parseMagnet(uri)
+		if err != nil {
+			t.Fatalf("could not parse magnet link: %s", err)
+		}
+
+		if string(m.infoHash[:]) != string(expected) {
+			t.Fatalf("expected info hash %s, got=%x", hexHash, m.infoHash)
+		}
+		if m.name != "debian.iso" {
+			t.Fatalf("expected name debian.iso, got=%s", m.name)
+		}
+		if len(m.trackers) != 2 || m.trackers[0] != "http://tracker.example/announce" {
+			t.Fatalf("got unexpected trackers %v", m.trackers)
+		}
+		if len(m.peers) != 1 || m.peers[0].String() != "10.0.0.2:6881" {
+			t.Fatalf("got unexpected peers %v", m.peers)
+		}
+		if len(m.webSeeds) != 1 || m.webSeeds[0] != "http://seed.example/debian.iso" {
+			t.Fatalf("got unexpected web seeds %v", m.webSeeds)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	tests := []string{
+		"http://example.com",
+		"magnet:?dn=nohash",
+		"magnet:?xt=urn:btih:1234",
+	}
+
+	for _, uri := range tests {
+		_, err := parseMagnet(uri)
+		if err == nil {
+			t.Fatalf("expected an error for %s", uri)
+		}
+	}
+}
+
+// metadataPeer is a client for a peer that speaks ut_metadata, the pieces we
+// ask it for come out of the channel.
+func metadataPeer(t *testing.T) (*client, <-chan int) {
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+
+	requests := make(chan int, 16)
+	go func() {
+		for {
+			msg, err := readMessage(theirs)
+			if err != nil {
+				return
+			}
+
+			_, piece, _, err := parseMetadataMessage(msg.Payload[1:])
+			if err == nil {
+				requests <- piece
+			}
+		}
+	}()
+
+	return &client{conn: ours, peerExtensions: map[string]int{extMetadataName: 3}}, requests
+}
+
+func expectRequests(t *testing.T, requests <-chan int, pieces ...int) {
+	t.Helper()
+
+	for _, piece := range pieces {
+		select {
+		case got := <-requests:
+			if got != piece {
+				t.Fatalf("expected a request for piece %d, got=%d", piece, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a request for piece %d", piece)
+		}
+	}
+}
+
+func TestMetadataFetcherVerifies(t *testing.T) {
+	raw := make([]byte, METADATAPIECESIZE+100)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	f := newMetadataFetcher(sha1.Sum(raw), [20]byte{}, encryptionDisabled)
+	good, goodRequests := metadataPeer(t)
+	bad, _ := metadataPeer(t)
+
+	missing, err := f.addPeer(good, len(raw))
+	if err != nil {
+		t.Fatalf("could not add the peer: %s", err)
+	}
+	if len(missing) != 2 {
+		t.Fatalf("expected 2 pieces to be missing, got=%d", len(missing))
+	}
+	f.addPeer(bad, len(raw))
+
+	// a corrupted piece makes the whole thing start over with the peers left
+	corrupted := append([]byte{}, raw[METADATAPIECESIZE:]...)
+	corrupted[0]++
+	f.receive(good, 0, raw[:METADATAPIECESIZE])
+	err = f.receive(bad, 1, corrupted)
+	if err == nil || f.finished() {
+		t.Fatalf("expected corrupted metadata to be rejected")
+	}
+	expectRequests(t, goodRequests, 0, 1)
+
+	f.receive(good, 0, raw[:METADATAPIECESIZE])
+	err = f.receive(good, 1, raw[METADATAPIECESIZE:])
+	if err != nil {
+		t.Fatalf("could not receive metadata: %s", err)
+	}
+	if !f.finished() || string(f.raw) != string(raw) {
+		t.Fatalf("expected the fetcher to be done with the right metadata")
+	}
+}
+
+func TestMetadataFetcherWrongSize(t *testing.T) {
+	raw := make([]byte, METADATAPIECESIZE+100)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+
+	f := newMetadataFetcher(sha1.Sum(raw), [20]byte{}, encryptionDisabled)
+	liar, _ := metadataPeer(t)
+	honest, honestRequests := metadataPeer(t)
+
+	// the first peer decides the size, the honest one has to wait
+	f.addPeer(liar, len(raw)+50)
+	missing, _ := f.addPeer(honest, len(raw))
+	if len(missing) != 0 {
+		t.Fatalf("expected nothing to be asked of a peer with another size, got=%v", missing)
+	}
+
+	f.receive(liar, 0, raw[:METADATAPIECESIZE])
+	err := f.receive(liar, 1, make([]byte, 150))
+	if err == nil {
+		t.Fatalf("expected metadata of the wrong size to be rejected")
+	}
+	expectRequests(t, honestRequests, 0, 1)
+
+	f.receive(honest, 0, raw[:METADATAPIECESIZE])
+	f.receive(honest, 1, raw[METADATAPIECESIZE:])
+	if !f.finished() {
+		t.Fatalf("expected the metadata of the honest peer to verify")
+	}
+}
+
+func TestMetadataFetcherPeerLeaves(t *testing.T) {
+	f := newMetadataFetcher([20]byte{}, [20]byte{}, encryptionDisabled)
+	first, _ := metadataPeer(t)
+	second, secondRequests := metadataPeer(t)
+
+	f.addPeer(first, 100)
+	f.addPeer(second, 200)
+
+	// nobody is left with the size we went with, so we go with the other one
+	f.removePeer(first)
+	expectRequests(t, secondRequests, 0)
+	if f.size != 200 {
+		t.Fatalf("expected the size to move on to 200, got=%d", f.size)
+	}
+}
+
+func TestMetadataServer(t *testing.T) {
+	metadata := make([]byte, METADATAPIECESIZE+10)
+	for i := range metadata {
+		metadata[i] = byte(i * 7)
+	}
+
+	registry := newExtensionRegistry()
+	registerMetadataServer(registry, metadata)
+	if registry.extra["metadata_size"] != len(metadata) {
+		t.Fatalf("expected metadata_size to be advertised")
+	}
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+
+	c := &client{
+		conn:           ours,
+		extensions:     registry,
+		peerExtensions: map[string]int{extMetadataName: 7},
+	}
+
+	f := newMetadataFetcher(sha1.Sum(metadata), [20]byte{}, encryptionDisabled)
+	f.addPeer(c, len(metadata))
+
+	for piece := 0; piece < 2; piece++ {
+		req, _ := bencode.Encode(bencode.Dictionary{"msg_type": metadataRequest, "piece": piece})
+		go c.handleExtended(append([]byte{1}, req...))
+
+		msg, err := readMessage(theirs)
+		if err != nil {
+			t.Fatalf("could not read the answer: %s", err)
+		}
+		if msg.ID != MsgExtended || msg.Payload[0] != 7 {
+			t.Fatalf("expected an extended message with id 7, got=%d %d", msg.ID, msg.Payload[0])
+		}
+
+		msgType, got, n, err := parseMetadataMessage(msg.Payload[1:])
+		if err != nil || msgType != metadataData || got != piece {
+			t.Fatalf("expected data for piece %d, got=%d %d %v", piece, msgType, got, err)
+		}
+
+		err = f.receive(c, piece, msg.Payload[1+n:])
+		if err != nil {
+			t.Fatalf("could not receive piece %d: %s", piece, err)
+		}
+	}
+
+	if !f.finished() {
+		t.Fatalf("expected the served metadata to verify")
+	}
+}
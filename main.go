@@ -3,40 +3,346 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/fs"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "seed":
+			seedMain(os.Args[2:])
+			return
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "verify":
+			verifyMain(os.Args[2:])
+			return
+		}
+	}
+
 	filename := ""
-	outname := ""
+	magnetURI := ""
+	outdir := ""
+	encryption := ""
+	slots := 0
+	sequential := false
+	storage := ""
+	allocation := ""
+	writeCache, readCache := 0, 0
+	var rechoke, optimistic, snub time.Duration
 	flag.StringVar(&filename, "path", "", "path to the torrent file")
-	flag.StringVar(&outname, "out", "", "name of the created file")
+	flag.StringVar(&magnetURI, "magnet", "", "magnet link to download instead of a torrent file")
+	flag.StringVar(&outdir, "out", ".", "directory the files of the torrent are written to")
+	flag.StringVar(&encryption, "encryption", "preferred", "peer connection encryption: disabled, preferred or required")
+	flag.IntVar(&slots, "upload-slots", UPLOADSLOTS, "number of peers we upload to at once")
+	flag.DurationVar(&rechoke, "rechoke-interval", RECHOKEINTERVAL, "how often the peers we upload to are picked again")
+	flag.DurationVar(&optimistic, "optimistic-interval", OPTIMISTICINTERVAL, "how often the optimistic unchoke moves on to another peer")
+	flag.DurationVar(&snub, "snub-timeout", SNUBTIMEOUT, "how long a peer can send us nothing before we stop counting on it")
+	flag.BoolVar(&sequential, "sequential", false, "download the pieces in order, to use the file before it is done")
+	flag.StringVar(&storage, "storage", "file", "how the files are accessed: file or mmap, which always allocates them in full")
+	flag.StringVar(&allocation, "allocation", "sparse", "how the files take up disk space: sparse or full")
+	flag.IntVar(&writeCache, "write-cache", WRITECACHESIZE>>20, "MiB of unfinished pieces to hold back and write together")
+	flag.IntVar(&readCache, "read-cache", READCACHESIZE>>20, "MiB of pieces to keep in memory for peers asking for them")
 	flag.Parse()
 
-	if filename == "" || outname == "" {
-		fmt.Fprintf(os.Stderr, "need a path and an out name\n")
+	if filename == "" && magnetURI == "" {
+		fmt.Fprintf(os.Stderr, "need a path or a magnet link\n")
 		os.Exit(1)
 	}
 
-	f, err := os.Open(filename)
+	policy, err := parseEncryptionPolicy(encryption)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not open file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
-	t, err := newTorrent(f)
+	open, err := parseStorage(storage)
 	if err != nil {
-		fmt.Printf("could not parse file into torrent: %s\n", err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	alloc, err := parseAllocation(allocation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t, err := openTorrent(filename, magnetURI, policy, slots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("Successfully parsed the torrent file")
 
-	file, err := Download(t)
+	err = t.SetChoker(rechoke, optimistic, snub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t.SetStorage(outdir, open)
+	t.SetAllocation(alloc)
+	t.config.writeCache = writeCache << 20
+	t.config.readCache = readCache << 20
+	if sequential {
+		t.SetPiecePicker(NewStreaming(STREAMWINDOW))
+	}
+
+	tr, err := Start(t)
+	if err != nil {
+		fmt.Println("could not start the download", err)
+		os.Exit(1)
+	}
+
+	// closing saves the progress, so an interrupted download picks up where
+	// it stopped
+	go func() {
+		<-interrupted()
+		tr.Close()
+	}()
+
+	err = tr.Wait()
+	tr.Close()
 	if err != nil {
 		fmt.Println("could not download the file", err)
 		os.Exit(1)
 	}
+}
+
+// seedMain serves the files of a torrent we already downloaded, until
+// interrupted.
+func seedMain(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	filename := flags.String("path", "", "path to the torrent file")
+	dir := flags.String("dir", ".", "directory the downloaded files of the torrent are in")
+	encryption := flags.String("encryption", "preferred", "peer connection encryption: disabled, preferred or required")
+	slots := flags.Int("upload-slots", UPLOADSLOTS, "number of peers we upload to at once")
+	rechoke := flags.Duration("rechoke-interval", RECHOKEINTERVAL, "how often the peers we upload to are picked again")
+	optimistic := flags.Duration("optimistic-interval", OPTIMISTICINTERVAL, "how often the optimistic unchoke moves on to another peer")
+	snub := flags.Duration("snub-timeout", SNUBTIMEOUT, "how long a peer can send us nothing before we stop counting on it")
+	storage := flags.String("storage", "file", "how the files are accessed: file or mmap, which always allocates them in full")
+	readCache := flags.Int("read-cache", READCACHESIZE>>20, "MiB of pieces to keep in memory for peers asking for them")
+	flags.Parse(args)
+
+	if *filename == "" {
+		fmt.Fprintf(os.Stderr, "need a path\n")
+		os.Exit(1)
+	}
+
+	policy, err := parseEncryptionPolicy(*encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	open, err := parseStorage(*storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t, err := openTorrent(*filename, "", policy, *slots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	err = t.SetChoker(*rechoke, *optimistic, *snub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t.SetStorage(*dir, open)
+	t.config.writeCache = 0 // there is nothing to write
+	t.config.readCache = *readCache << 20
+
+	done := make(chan struct{})
+	go func() {
+		<-interrupted()
+		close(done)
+	}()
+
+	err = Seed(t, done)
+	if err != nil {
+		fmt.Println("could not seed the file", err)
+		os.Exit(1)
+	}
+}
+
+// serveMain downloads a torrent and serves its files over http while they
+// come in, until interrupted.
+func serveMain(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	filename := flags.String("path", "", "path to the torrent file")
+	magnetURI := flags.String("magnet", "", "magnet link to serve instead of a torrent file")
+	addr := flags.String("addr", "localhost:8080", "address to serve http on")
+	outdir := flags.String("out", ".", "directory the files of the torrent are written to")
+	encryption := flags.String("encryption", "preferred", "peer connection encryption: disabled, preferred or required")
+	slots := flags.Int("upload-slots", UPLOADSLOTS, "number of peers we upload to at once")
+	rechoke := flags.Duration("rechoke-interval", RECHOKEINTERVAL, "how often the peers we upload to are picked again")
+	optimistic := flags.Duration("optimistic-interval", OPTIMISTICINTERVAL, "how often the optimistic unchoke moves on to another peer")
+	snub := flags.Duration("snub-timeout", SNUBTIMEOUT, "how long a peer can send us nothing before we stop counting on it")
+	storage := flags.String("storage", "file", "how the files are accessed: file or mmap, which always allocates them in full")
+	writeCache := flags.Int("write-cache", WRITECACHESIZE>>20, "MiB of unfinished pieces to hold back and write together")
+	readCache := flags.Int("read-cache", READCACHESIZE>>20, "MiB of pieces to keep in memory for peers asking for them")
+	allocation := flags.String("allocation", "sparse", "how the files take up disk space: sparse or full")
+	flags.Parse(args)
+
+	if *filename == "" && *magnetURI == "" {
+		fmt.Fprintf(os.Stderr, "need a path or a magnet link\n")
+		os.Exit(1)
+	}
+
+	policy, err := parseEncryptionPolicy(*encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	open, err := parseStorage(*storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	alloc, err := parseAllocation(*allocation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t, err := openTorrent(*filename, *magnetURI, policy, *slots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	err = t.SetChoker(*rechoke, *optimistic, *snub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	t.SetStorage(*outdir, open)
+	t.SetAllocation(alloc)
+	t.config.writeCache = *writeCache << 20
+	t.config.readCache = *readCache << 20
+	// the pieces nobody is reading are best fetched in order too
+	t.SetPiecePicker(NewStreaming(STREAMWINDOW))
+
+	tr, err := Start(t)
+	if err != nil {
+		fmt.Println("could not start the download", err)
+		os.Exit(1)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: tr.Handler()}
+	go func() {
+		<-interrupted()
+		tr.Close()
+		srv.Close()
+	}()
+
+	fmt.Printf("serving %s on http://%s/\n", t.info.name, *addr)
+	err = srv.ListenAndServe()
+	// the transfer has to be closed before we exit, or the progress is lost
+	tr.Close()
+	if err != http.ErrServerClosed {
+		fmt.Println("could not serve http", err)
+		os.Exit(1)
+	}
+}
+
+// verifyMain hashes the files of a torrent on disk and reports how much of
+// each file is good, it exits with 1 if anything is missing or broken.
+func verifyMain(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	filename := flags.String("path", "", "path to the torrent file")
+	dir := flags.String("dir", ".", "directory the files of the torrent are in")
+	flags.Parse(args)
+
+	if *filename == "" {
+		fmt.Fprintf(os.Stderr, "need a path\n")
+		os.Exit(1)
+	}
+
+	t, err := openTorrent(*filename, "", encryptionPreferred, UPLOADSLOTS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	storage, err := openReadOnlyStorage(t.info, *dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open the files: %s\n", err)
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	st := newPieceStore(t.info, storage)
+	n := recheck(st)
+
+	for _, fp := range st.fileProgress() {
+		percent := 100.0
+		if fp.length > 0 {
+			percent = float64(fp.have) / float64(fp.length) * 100
+		}
+		fmt.Printf("(%6.2f%%) %s\n", percent, fp.path)
+	}
+	fmt.Printf("%d of %d pieces match the torrent\n", n, len(t.info.pieces))
+
+	if !st.complete() {
+		storage.Close()
+		os.Exit(1)
+	}
+}
+
+// interrupted returns a channel that gets a value when we are asked to stop.
+func interrupted() <-chan os.Signal {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	return interrupt
+}
+
+// openTorrent reads the torrent file, or fetches the metadata of the magnet
+// link from peers.
+func openTorrent(filename, magnetURI string, policy encryptionPolicy, slots int) (*Torrent, error) {
+	if magnetURI != "" {
+		t, err := newTorrentFromMagnet(magnetURI)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse magnet link: %s", err)
+		}
+		t.config.encryption = policy
+		t.config.uploadSlots = slots
+
+		err = fetchMetadata(t)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch the metadata: %s", err)
+		}
+
+		return t, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %s", err)
+	}
+	defer f.Close()
+
+	t, err := newTorrent(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse file into torrent: %s", err)
+	}
+	fmt.Println("Successfully parsed the torrent file")
+	t.config.encryption = policy
+	t.config.uploadSlots = slots
 
-	os.WriteFile(outname, file, fs.ModePerm)
+	return t, nil
 }
@@ -19,6 +19,18 @@ const (
 	MsgCancel
 )
 
+// Messages of the fast extension (BEP 6)
+const (
+	MsgSuggest messageID = iota + 0x0D
+	MsgHaveAll
+	MsgHaveNone
+	MsgRejectRequest
+	MsgAllowedFast
+)
+
+// MsgExtended wraps the messages of the extension protocol (BEP 10)
+const MsgExtended messageID = 20
+
 type Message struct {
 	ID      messageID
 	Payload []byte
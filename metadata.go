@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+const extMetadataName = "ut_metadata"
+
+const (
+	METADATAPIECESIZE = 16384
+	MAXMETADATASIZE   = 8 << 20 // refuse info dicts bigger than 8 MiB
+	METADATATIMEOUT   = 5 * time.Minute
+	METADATAREADWAIT  = 30 * time.Second // how long a peer can stay quiet
+)
+
+// ut_metadata message types (BEP 9)
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataFetcher puts the info dict of a magnet link together from the
+// pieces peers send us over ut_metadata.
+type metadataFetcher struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	policy   encryptionPolicy
+
+	mu     sync.Mutex
+	sizes  map[*client]int // the metadata size every peer told us
+	failed map[int]bool    // sizes we put together that didn't match the info hash
+	size   int             // the size we are putting together, 0 before any peer told us
+	pieces [][]byte
+	raw    []byte
+	done   chan struct{} // closed once raw holds the verified info dict
+}
+
+func newMetadataFetcher(infoHash, peerID [20]byte, policy encryptionPolicy) *metadataFetcher {
+	return &metadataFetcher{
+		infoHash: infoHash,
+		peerID:   peerID,
+		policy:   policy,
+		sizes:    make(map[*client]int),
+		failed:   make(map[int]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+func numMetadataPieces(size int) int {
+	return (size + METADATAPIECESIZE - 1) / METADATAPIECESIZE
+}
+
+func (f *metadataFetcher) extension() *extensionHandler {
+	return &extensionHandler{
+		name: extMetadataName,
+		handshake: func(c *client, hs *extendedHandshake) error {
+			size, ok := hs.dict["metadata_size"].(int)
+			if !ok || hs.m[extMetadataName] == 0 {
+				return nil // the peer can't help us with the metadata
+			}
+
+			missing, err := f.addPeer(c, size)
+			if err != nil {
+				return err
+			}
+
+			return f.request(c, missing)
+		},
+		handle: func(c *client, payload []byte) error {
+			msgType, piece, n, err := parseMetadataMessage(payload)
+			if err != nil {
+				return err
+			}
+
+			switch msgType {
+			case metadataRequest:
+				// we don't have the info dict ourselves yet
+				id := c.extensionID(extMetadataName)
+				if id == 0 {
+					return nil
+				}
+				return c.sendExtended(id, bencode.Dictionary{"msg_type": metadataReject, "piece": piece})
+			case metadataData:
+				return f.receive(c, piece, payload[n:])
+			case metadataReject:
+				return errors.New("the peer rejected our metadata request")
+			}
+
+			return nil
+		},
+	}
+}
+
+// registerMetadataServer answers the ut_metadata requests of peers that got
+// the torrent from a magnet link with pieces of our info dict.
+func registerMetadataServer(extensions *extensionRegistry, metadata []byte) {
+	extensions.extra["metadata_size"] = len(metadata)
+
+	extensions.register(&extensionHandler{
+		name: extMetadataName,
+		handle: func(c *client, payload []byte) error {
+			msgType, piece, _, err := parseMetadataMessage(payload)
+			if err != nil {
+				return err
+			}
+
+			if msgType != metadataRequest {
+				return nil // we never ask for the metadata ourselves
+			}
+
+			id := c.extensionID(extMetadataName)
+			if id == 0 {
+				return nil
+			}
+
+			if piece >= numMetadataPieces(len(metadata)) {
+				return c.sendExtended(id, bencode.Dictionary{"msg_type": metadataReject, "piece": piece})
+			}
+
+			start := piece * METADATAPIECESIZE
+			end := start + METADATAPIECESIZE
+			if end > len(metadata) {
+				end = len(metadata)
+			}
+
+			header, err := bencode.Encode(bencode.Dictionary{
+				"msg_type":   metadataData,
+				"piece":      piece,
+				"total_size": len(metadata),
+			})
+			if err != nil {
+				return err
+			}
+
+			return c.sendExtendedRaw(id, append(header, metadata[start:end]...))
+		},
+	})
+}
+
+// parseMetadataMessage returns the type and piece of a ut_metadata message and
+// where the data after the dictionary starts.
+func parseMetadataMessage(payload []byte) (int, int, int, error) {
+	val, n, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	dict, ok := val.(bencode.Dictionary)
+	if !ok {
+		return 0, 0, 0, errors.New("expected metadata message to be a dictionary")
+	}
+
+	msgType, ok := dict["msg_type"].(int)
+	if !ok {
+		return 0, 0, 0, errors.New("expected msg_type to be int")
+	}
+
+	piece, ok := dict["piece"].(int)
+	if !ok || piece < 0 {
+		return 0, 0, 0, errors.New("expected piece to be a positive int")
+	}
+
+	return msgType, piece, n, nil
+}
+
+// addPeer records the metadata size a peer told us and returns the pieces to
+// ask it for. The first peer decides the size we go with, the peers that
+// disagree get asked once that size fails the hash check.
+func (f *metadataFetcher) addPeer(c *client, size int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= 0 || size > MAXMETADATASIZE {
+		return nil, fmt.Errorf("got invalid metadata size %d", size)
+	}
+
+	f.sizes[c] = size
+	if f.size == 0 {
+		f.use(size)
+	}
+
+	if size != f.size {
+		return nil, nil
+	}
+
+	return f.missing(), nil
+}
+
+// removePeer forgets a peer that went away. If it was the last one with the
+// size we are putting together, we move on to the size of the others.
+func (f *metadataFetcher) removePeer(c *client) {
+	f.mu.Lock()
+	delete(f.sizes, c)
+
+	if f.raw != nil {
+		f.mu.Unlock()
+		return
+	}
+	for _, size := range f.sizes {
+		if size == f.size {
+			f.mu.Unlock()
+			return
+		}
+	}
+
+	peers := f.switchSize()
+	f.mu.Unlock()
+
+	f.rerequest(peers)
+}
+
+func (f *metadataFetcher) use(size int) {
+	f.size = size
+	f.pieces = make([][]byte, numMetadataPieces(size))
+}
+
+func (f *metadataFetcher) missing() []int {
+	missing := []int{}
+	for i, p := range f.pieces {
+		if p == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	return missing
+}
+
+// switchSize throws away the pieces and starts over on a size some peer told
+// us, preferring ones that didn't fail yet. It returns the peers to ask.
+func (f *metadataFetcher) switchSize() []*client {
+	next := 0
+	for _, size := range f.sizes {
+		if !f.failed[size] {
+			next = size
+			break
+		}
+	}
+	if next == 0 && len(f.sizes) > 0 {
+		// every size failed, somebody could have sent garbage for the right one
+		clear(f.failed)
+		for _, size := range f.sizes {
+			next = size
+			break
+		}
+	}
+	f.use(next)
+
+	peers := []*client{}
+	for c, size := range f.sizes {
+		if size == next {
+			peers = append(peers, c)
+		}
+	}
+
+	return peers
+}
+
+// request asks a peer for the metadata pieces.
+func (f *metadataFetcher) request(c *client, pieces []int) error {
+	id := c.extensionID(extMetadataName)
+	for _, piece := range pieces {
+		err := c.sendExtended(id, bencode.Dictionary{"msg_type": metadataRequest, "piece": piece})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rerequest asks the peers for every piece we miss after starting over.
+func (f *metadataFetcher) rerequest(peers []*client) {
+	f.mu.Lock()
+	missing := f.missing()
+	f.mu.Unlock()
+
+	for _, c := range peers {
+		// a peer we can't write to gets dropped by its own loop
+		f.request(c, missing)
+	}
+}
+
+func (f *metadataFetcher) receive(c *client, piece int, data []byte) error {
+	peers, err := f.store(c, piece, data)
+	f.rerequest(peers)
+
+	return err
+}
+
+// store keeps a piece a peer sent us and checks the info dict once it is
+// complete. If it doesn't match the info hash it returns the peers to ask
+// again.
+func (f *metadataFetcher) store(c *client, piece int, data []byte) ([]*client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.raw != nil {
+		return nil, nil // we are already done
+	}
+
+	if f.sizes[c] != f.size {
+		return nil, nil // a piece of a size we gave up on
+	}
+
+	if piece >= len(f.pieces) {
+		return nil, errors.New("got a metadata piece we never asked for")
+	}
+
+	expected := METADATAPIECESIZE
+	if piece == len(f.pieces)-1 {
+		expected = f.size - piece*METADATAPIECESIZE
+	}
+	if len(data) != expected {
+		return nil, errors.New("got a metadata piece of the wrong size")
+	}
+
+	f.pieces[piece] = append([]byte{}, data...)
+
+	for _, p := range f.pieces {
+		if p == nil {
+			return nil, nil
+		}
+	}
+
+	raw := bytes.Join(f.pieces, nil)
+	hash := sha1.Sum(raw)
+	if !bytes.Equal(hash[:], f.infoHash[:]) {
+		// somebody sent us garbage or lied about the size, the peer that
+		// finished it goes and the rest start over
+		f.failed[f.size] = true
+		delete(f.sizes, c)
+
+		return f.switchSize(), errors.New("the metadata did not match the info hash")
+	}
+
+	f.raw = raw
+	close(f.done)
+
+	return nil, nil
+}
+
+func (f *metadataFetcher) finished() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *metadataFetcher) fetchFrom(s *swarm, extensions *extensionRegistry, peer Peer) {
+	s.acquire()
+	defer s.release()
+
+	if f.finished() {
+		return
+	}
+
+	// we don't know how many pieces there are before we have the metadata
+	c, err := newClient(peer, f.peerID, f.infoHash, nil, extensions, f.policy)
+	if err != nil {
+		s.forget(peer)
+		return
+	}
+	defer c.close()
+
+	if !c.extended {
+		return // no extension protocol, no metadata
+	}
+	defer f.removePeer(c)
+
+	s.connect(peer, pexReachable)
+	defer s.disconnect(peer)
+
+	err = c.sendExtendedHandshake()
+	if err != nil {
+		return
+	}
+
+	for !f.finished() {
+		c.conn.SetReadDeadline(time.Now().Add(METADATAREADWAIT))
+
+		msg, err := c.read()
+		if err != nil {
+			return
+		}
+
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+
+		err = c.handleExtended(msg.Payload)
+		if err != nil {
+			fmt.Println("dropping peer", peer.IP, err)
+			return
+		}
+	}
+}
+
+// fetchMetadata downloads the info dict of a torrent built from a magnet link
+// and fills in t.info once it matches the info hash.
+func fetchMetadata(t *Torrent) error {
+	fmt.Println("fetching metadata for", t.info.name)
+
+	peers, err := getPeers(t)
+	if err != nil {
+		if len(t.peers) == 0 {
+			return err
+		}
+		fmt.Println("could not get peers from the tracker:", err)
+	}
+
+	s := newSwarm()
+	for _, peer := range append(t.peers, peers...) {
+		s.addPeer(peer)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	f := newMetadataFetcher(t.info.infoHash, t.peerID, t.config.encryption)
+	extensions := newExtensionRegistry()
+
+	// we can't tell a private torrent before we have the info dict, but one
+	// without a tracker can't be private so it may find peers on its own
+	if t.announce == "" {
+		err = startLSD(t, s, done)
+		if err != nil {
+			return err
+		}
+		extensions.register(pexExtension(s))
+	}
+	extensions.register(f.extension())
+
+	timeout := time.After(METADATATIMEOUT)
+	for {
+		select {
+		case peer := <-s.newPeers:
+			go f.fetchFrom(s, extensions, peer)
+		case <-f.done:
+			dict, err := decodeDict(f.raw)
+			if err != nil {
+				return err
+			}
+
+			info, err := buildInfo(dict)
+			if err != nil {
+				return err
+			}
+			// the hash we verified the raw bytes against is the real one
+			info.infoHash = t.info.infoHash
+			info.metadata = f.raw
+
+			t.info = info
+			t.peers = s.knownPeers()
+
+			fmt.Println("got the metadata for", t.info.name)
+			return nil
+		case <-timeout:
+			return errors.New("timed out waiting for the metadata from peers")
+		}
+	}
+}
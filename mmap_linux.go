@@ -0,0 +1,170 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MAXMAPPED is the most content we map at once, a 32 bit address space only
+// has room for a gigabyte or so next to everything else.
+const MAXMAPPED = 1 << (strconv.IntSize - 2)
+
+// mmapStorage maps every file of the torrent into memory, reads and writes
+// are copies into and out of the mappings and the kernel does the io.
+type mmapStorage struct {
+	info  *TorrentFile
+	files []*os.File
+
+	mu     sync.RWMutex // the mappings can't go away in the middle of a copy
+	maps   [][]byte     // nil for empty files, they can't be mapped
+	closed bool
+}
+
+var errStorageClosed = errors.New("the storage is closed")
+
+// openMmapStorage maps the files of the torrent under dir, when they don't
+// fit in the address space it falls back to plain files.
+func openMmapStorage(info *TorrentFile, dir string) (Storage, error) {
+	if info.length > MAXMAPPED {
+		fmt.Println("the torrent is too big to map, using plain files")
+		return openFileStorage(info, dir)
+	}
+
+	files, err := openFiles(info, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	ms := &mmapStorage{info: info, files: files}
+
+	for i, f := range info.files {
+		m, err := mapFile(files[i], f.length)
+		if err != nil {
+			ms.Close()
+			fmt.Println("could not map", f.path, "using plain files:", err)
+			return openFileStorage(info, dir)
+		}
+		ms.maps = append(ms.maps, m)
+	}
+
+	return ms, nil
+}
+
+// mapFile reserves the disk space for the whole file and maps it. A write
+// into a sparse mapping on a full disk can't return an error, the process
+// gets a SIGBUS instead, so the mapped files are always allocated in full.
+func mapFile(file *os.File, length int) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+
+	err := preallocate(file, int64(length))
+	if err != nil {
+		return nil, err
+	}
+
+	return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (ms *mmapStorage) ReadAt(p []byte, index, begin int) (int, error) {
+	off, err := ms.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return 0, errStorageClosed
+	}
+
+	n := 0
+	for _, span := range ms.info.fileSpans(off, len(p)) {
+		n += copy(p[span.start:span.start+span.length], ms.maps[span.file][span.offset:])
+	}
+
+	return n, nil
+}
+
+func (ms *mmapStorage) WriteAt(p []byte, index, begin int) (int, error) {
+	off, err := ms.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return 0, errStorageClosed
+	}
+
+	n := 0
+	for _, span := range ms.info.fileSpans(off, len(p)) {
+		n += copy(ms.maps[span.file][span.offset:], p[span.start:span.start+span.length])
+	}
+
+	return n, nil
+}
+
+// Sync waits for the dirty pages of every mapping to hit the disk.
+func (ms *mmapStorage) Sync() error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return errStorageClosed
+	}
+
+	return ms.sync()
+}
+
+func (ms *mmapStorage) sync() error {
+	for _, m := range ms.maps {
+		if len(m) == 0 {
+			continue
+		}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m[0])), uintptr(len(m)), syscall.MS_SYNC)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
+
+func (ms *mmapStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return errStorageClosed
+	}
+	ms.closed = true
+
+	first := ms.sync()
+	for _, m := range ms.maps {
+		if m == nil {
+			continue
+		}
+
+		err := syscall.Munmap(m)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	ms.maps = nil
+
+	for _, f := range ms.files {
+		err := f.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
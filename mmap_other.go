@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// openMmapStorage only maps files on linux, everywhere else it uses plain
+// files.
+func openMmapStorage(info *TorrentFile, dir string) (Storage, error) {
+	return openFileStorage(info, dir)
+}
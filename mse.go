@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Message stream encryption, the obfuscation most clients call protocol
+// encryption. A Diffie-Hellman exchange gives both sides a shared secret that
+// keys an RC4 stream for the rest of the connection.
+
+const (
+	MSEKEYSIZE    = 96  // size of the public keys in bytes
+	MSEMAXPAD     = 512 // padding after the public keys and in the handshake
+	MSETIMEOUT    = 10 * time.Second
+	MSEDISCARDLEN = 1024 // bytes of rc4 keystream thrown away before use
+)
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+var (
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	mseVC   = make([]byte, 8) // the verification constant, 8 zero bytes
+)
+
+// mseConn is a connection that went through the encryption handshake. Bytes
+// in prefix were read during the handshake and are handed out first.
+type mseConn struct {
+	net.Conn
+	prefix []byte
+	enc    *rc4.Cipher // nil when the peers settled on plaintext
+	dec    *rc4.Cipher
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+
+	return c.Conn.Write(buf)
+}
+
+func isEncrypted(conn net.Conn) bool {
+	c, ok := conn.(*mseConn)
+	return ok && c.enc != nil
+}
+
+func isUTP(conn net.Conn) bool {
+	if c, ok := conn.(*mseConn); ok {
+		conn = c.Conn
+	}
+
+	_, ok := conn.(*utpConn)
+	return ok
+}
+
+func hashOf(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
+
+func newMSEKey() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv := new(big.Int).SetBytes(buf)
+	pub := new(big.Int).Exp(mseG, priv, mseP)
+
+	return priv, pub.FillBytes(make([]byte, MSEKEYSIZE)), nil
+}
+
+func sharedSecret(priv *big.Int, otherPub []byte) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(otherPub), priv, mseP)
+	return s.FillBytes(make([]byte, MSEKEYSIZE))
+}
+
+func newMSECipher(name string, secret []byte, infoHash [20]byte) (*rc4.Cipher, error) {
+	cipher, err := rc4.NewCipher(hashOf([]byte(name), secret, infoHash[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	discard := make([]byte, MSEDISCARDLEN)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher, nil
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(MSEMAXPAD+1))
+	_, err = rand.Read(pad)
+	if err != nil {
+		return nil, err
+	}
+
+	return pad, nil
+}
+
+// readUntil reads from r until the stream ends with pattern, giving up after
+// max bytes.
+func readUntil(r io.Reader, pattern []byte, max int) error {
+	buf := make([]byte, 0, max)
+	b := make([]byte, 1)
+
+	for len(buf) < max {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, b[0])
+		if bytes.HasSuffix(buf, pattern) {
+			return nil
+		}
+	}
+
+	return errors.New("could not find the sync point of the encryption handshake")
+}
+
+// mseInitiate runs the encryption handshake as the side that opened the
+// connection and offers the methods in provide.
+func mseInitiate(conn net.Conn, infoHash [20]byte, provide uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(MSETIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	priv, pub, err := newMSEKey()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(pub, padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	otherPub := make([]byte, MSEKEYSIZE)
+	_, err = io.ReadFull(conn, otherPub)
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(priv, otherPub)
+
+	enc, err := newMSECipher("keyA", secret, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newMSECipher("keyB", secret, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	req2 := hashOf([]byte("req2"), infoHash[:])
+	req3 := hashOf([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), we send no padding and no
+	// initial payload
+	header := make([]byte, 8+4+2+2)
+	copy(header, mseVC)
+	binary.BigEndian.PutUint32(header[8:12], provide)
+	enc.XORKeyStream(header, header)
+
+	msg := hashOf([]byte("req1"), secret)
+	msg = append(msg, req2...)
+	msg = append(msg, header...)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the other side's VC shows up encrypted somewhere after its padding
+	vcCipher := *dec
+	encVC := make([]byte, len(mseVC))
+	vcCipher.XORKeyStream(encVC, mseVC)
+
+	err = readUntil(conn, encVC, MSEMAXPAD+len(encVC))
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(encVC, encVC)
+
+	buf := make([]byte, 4+2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+
+	selected := binary.BigEndian.Uint32(buf[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(buf[4:]))
+	if len(padD) > MSEMAXPAD {
+		return nil, errors.New("got too much padding in the encryption handshake")
+	}
+	_, err = io.ReadFull(conn, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case selected == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &mseConn{Conn: conn, enc: enc, dec: dec}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return conn, nil
+	}
+
+	return nil, errors.New("the peer selected an encryption method we did not offer")
+}
+
+// mseRespond runs the encryption handshake for a connection the other side
+// opened. prefix holds the bytes already read from conn and infoHashes the
+// torrents the peer may be asking for.
+func mseRespond(conn net.Conn, prefix []byte, infoHashes [][20]byte, allowed uint32) (net.Conn, [20]byte, error) {
+	var infoHash [20]byte
+
+	conn.SetDeadline(time.Now().Add(MSETIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	r := io.MultiReader(bytes.NewReader(prefix), conn)
+
+	otherPub := make([]byte, MSEKEYSIZE)
+	_, err := io.ReadFull(r, otherPub)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	priv, pub, err := newMSEKey()
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	_, err = conn.Write(append(pub, padB...))
+	if err != nil {
+		return nil, infoHash, err
+	}
+	secret := sharedSecret(priv, otherPub)
+
+	err = readUntil(r, hashOf([]byte("req1"), secret), MSEMAXPAD+sha1.Size)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	skey := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, skey)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	req3 := hashOf([]byte("req3"), secret)
+	found := false
+	for _, ih := range infoHashes {
+		req2 := hashOf([]byte("req2"), ih[:])
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+
+		if bytes.Equal(req2, skey) {
+			infoHash = ih
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, infoHash, errors.New("the peer asked for a torrent we don't have")
+	}
+
+	dec, err := newMSECipher("keyA", secret, infoHash)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	enc, err := newMSECipher("keyB", secret, infoHash)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	header := make([]byte, 8+4+2)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, infoHash, errors.New("got a bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+
+	padC := make([]byte, binary.BigEndian.Uint16(header[12:]))
+	if len(padC) > MSEMAXPAD {
+		return nil, infoHash, errors.New("got too much padding in the encryption handshake")
+	}
+	_, err = io.ReadFull(r, padC)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(padC, padC)
+
+	lenIA := make([]byte, 2)
+	_, err = io.ReadFull(r, lenIA)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(lenIA, lenIA)
+
+	// the initial payload is usually the start of the bittorrent handshake
+	ia := make([]byte, binary.BigEndian.Uint16(lenIA))
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&allowed&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&allowed&cryptoPlaintext != 0:
+		selected = cryptoPlaintext
+	default:
+		return nil, infoHash, errors.New("could not agree on an encryption method with the peer")
+	}
+
+	reply := make([]byte, 8+4+2)
+	copy(reply, mseVC)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &mseConn{Conn: conn, prefix: ia}, infoHash, nil
+	}
+
+	return &mseConn{Conn: conn, prefix: ia, enc: enc, dec: dec}, infoHash, nil
+}
+
+// dialPeer opens a connection to the peer and runs the encryption handshake
+// the policy asks for.
+func dialPeer(peer Peer, infoHash [20]byte, policy encryptionPolicy) (net.Conn, error) {
+	conn, err := dialTransport(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == encryptionDisabled {
+		return conn, nil
+	}
+
+	provide := cryptoRC4
+	if policy == encryptionPreferred {
+		provide |= cryptoPlaintext
+	}
+
+	encrypted, err := mseInitiate(conn, infoHash, provide)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+
+	if policy == encryptionRequired {
+		return nil, err
+	}
+
+	// the peer might not speak the encryption handshake at all
+	return dialTransport(peer)
+}
+
+// dialTransport connects over tcp, and over utp for the peers that only
+// take that.
+func dialTransport(peer Peer) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	if err == nil {
+		return conn, nil
+	}
+
+	return dialUTP(peer.String(), 3*time.Second)
+}
+
+// acceptPeer works out if an incoming connection starts with a plaintext
+// bittorrent handshake or an encryption handshake and sets it up.
+func acceptPeer(conn net.Conn, infoHashes [][20]byte, policy encryptionPolicy) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(MSETIMEOUT))
+	prefix := make([]byte, 1+len(PEER_STRING))
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if prefix[0] == byte(len(PEER_STRING)) && string(prefix[1:]) == PEER_STRING {
+		if policy == encryptionRequired {
+			return nil, errors.New("the peer tried to connect without encryption")
+		}
+
+		return &mseConn{Conn: conn, prefix: prefix}, nil
+	}
+
+	if policy == encryptionDisabled {
+		return nil, errors.New("the peer tried to connect with encryption")
+	}
+
+	allowed := cryptoRC4
+	if policy == encryptionPreferred {
+		allowed |= cryptoPlaintext
+	}
+
+	encrypted, _, err := mseRespond(conn, prefix, infoHashes, allowed)
+	return encrypted, err
+}
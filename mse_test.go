@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// msePair runs the encryption handshake over a loopback connection and returns
+// both ends.
+func msePair(t *testing.T, provide, allowed uint32) (net.Conn, net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer ln.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan accepted)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch <- accepted{nil, err}
+			return
+		}
+
+		prefix := make([]byte, 20)
+		io.ReadFull(conn, prefix)
+		c, _, err := mseRespond(conn, prefix, [][20]byte{{9}, infoHash}, allowed)
+		if err != nil {
+			conn.Close() // what listenForPeers does, so the other side notices
+		}
+		ch <- accepted{c, err}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+
+	out, err := mseInitiate(conn, infoHash, provide)
+	in := <-ch
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.err != nil {
+		return nil, nil, in.err
+	}
+
+	return out, in.conn, nil
+}
+
+func TestMSE(t *testing.T) {
+	tests := []struct {
+		provide   uint32
+		allowed   uint32
+		encrypted bool
+	}{
+		{provide: cryptoRC4 | cryptoPlaintext, allowed: cryptoRC4 | cryptoPlaintext, encrypted: true},
+		{provide: cryptoRC4 | cryptoPlaintext, allowed: cryptoPlaintext, encrypted: false},
+		{provide: cryptoRC4, allowed: cryptoRC4, encrypted: true},
+	}
+
+	for _, tt := range tests {
+		out, in, err := msePair(t, tt.provide, tt.allowed)
+		if err != nil {
+			t.Fatalf("could not complete the encryption handshake: %s", err)
+		}
+
+		if isEncrypted(out) != tt.encrypted || isEncrypted(in) != tt.encrypted {
+			t.Fatalf("expected encrypted to be %v", tt.encrypted)
+		}
+
+		h := newHandshake([20]byte{1, 2, 3}, [20]byte{4})
+		go out.Write(h.serialize())
+
+		got, err := deserializeHandshake(in)
+		if err != nil {
+			t.Fatalf("could not read the handshake through the stream: %s", err)
+		}
+		if got.infoHash != h.infoHash {
+			t.Fatalf("got a garbled handshake %v", got)
+		}
+
+		go in.Write([]byte("reply"))
+		buf := make([]byte, 5)
+		io.ReadFull(out, buf)
+		if string(buf) != "reply" {
+			t.Fatalf("expected reply, got=%q", buf)
+		}
+
+		out.Close()
+		in.Close()
+	}
+}
+
+func TestMSENoCommonMethod(t *testing.T) {
+	_, _, err := msePair(t, cryptoPlaintext, cryptoRC4)
+	if err == nil {
+		t.Fatalf("expected the handshake to fail without a common method")
+	}
+}
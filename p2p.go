@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -23,174 +24,562 @@ type piece struct {
 
 type result struct {
 	index int
-	data  []byte
 }
 
 type pieceState struct {
-	c          *client
-	buf        []byte
-	index      int
-	downloaded int
-	requested  int
-	backlog    int
+	sess *session
+	c    *client
+	ap   *activePiece
 }
 
-func Download(t *Torrent) ([]byte, error) {
+// session is everything the connections of one download or seed share.
+type session struct {
+	t          *Torrent
+	swarm      *swarm
+	store      *pieceStore
+	extensions *extensionRegistry
+	choker     *choker
+	active     *activePieces
+	picker     *picker
+	stats      transferStats
+	verifyQ    chan verifyJob
+	results    chan *result
+	done       <-chan struct{} // closed when the session ends
+}
+
+// Download gets the whole torrent into its storage.
+func Download(t *Torrent) error {
+	tr, err := Start(t)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	return tr.Wait()
+}
+
+// Transfer is a download running in the background.
+type Transfer struct {
+	sess      *session
+	results   chan *result
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+	finished  chan struct{} // closed once we have every piece
+}
+
+// Start begins downloading the torrent in the background, its content can be
+// read with NewReader while it comes in.
+func Start(t *Torrent) (*Transfer, error) {
 	fmt.Println("starting download for", t.info.name)
 
-	workQueue := make(chan *piece, len(t.info.pieces))
-	results := make(chan *result)
+	tr := &Transfer{
+		results:  make(chan *result),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
 
-	for index, hash := range t.info.pieces {
-		workQueue <- &piece{index, hash, t.info.pieceLength}
+	// full allocation and mmap give new files their size, so what is on disk
+	// has to be looked at before
+	existing, err := statFiles(t.info, t.config.dir)
+	if err != nil {
+		fmt.Println("could not look for existing files", err)
 	}
 
-	peers, err := getPeers(t)
+	err = prepareFiles(t.info, t.config.dir, t.config.allocation)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := openStorage(t)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, peer := range peers {
-		go startWorker(t, peer, workQueue, results)
+	st := newPieceStore(t.info, storage)
+	rd := resume(t, st)
+	if rd == nil {
+		recheckExisting(t, st, existing)
+	}
+
+	sess, err := startSession(t, st, tr.results, tr.done)
+	if err != nil {
+		close(tr.done)
+		storage.Close()
+		return nil, err
+	}
+	if rd != nil {
+		sess.resumeSession(rd)
+	}
+	tr.sess = sess
+
+	go tr.run()
+
+	return tr, nil
+}
+
+func (tr *Transfer) run() {
+	t, sess := tr.sess.t, tr.sess
+
+	donePieces := sess.store.count()
+	if donePieces == len(t.info.pieces) {
+		close(tr.finished)
+	}
+
+	save := time.NewTicker(RESUMEINTERVAL)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-tr.done:
+			return
+		case <-save.C:
+			err := sess.saveResume()
+			if err != nil {
+				fmt.Println("could not save the resume file", err)
+			}
+		case peer := <-sess.swarm.newPeers:
+			go sess.startWorker(peer)
+		case res := <-tr.results:
+			donePieces++
+			sess.picker.done(res.index)
+
+			// without a reader a streaming download moves its window along
+			// as the pieces come in
+			if s, ok := t.config.picker.(*Streaming); ok {
+				s.SetCursor(sess.store.firstMissing())
+			}
+
+			percent := float64(donePieces) / float64(len(t.info.pieces)) * 100
+			fmt.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, sess.swarm.numConnected())
+
+			if donePieces == len(t.info.pieces) {
+				close(tr.finished)
+			}
+		}
+	}
+}
+
+// Wait blocks until the download is done.
+func (tr *Transfer) Wait() error {
+	select {
+	case <-tr.finished:
+		return nil
+	case <-tr.done:
+		return errTransferClosed
+	}
+}
+
+// Close stops the download, drops every peer, saves the progress and closes
+// the storage.
+func (tr *Transfer) Close() {
+	tr.closeOnce.Do(func() {
+		close(tr.done)
+
+		err := tr.sess.saveResume()
+		if err != nil {
+			fmt.Println("could not save the resume file", err)
+		}
+
+		if cs, ok := tr.sess.store.storage.(*cachedStorage); ok {
+			fmt.Println("cache:", cs.currentStats())
+		}
+
+		err = tr.sess.store.close()
+		if err != nil {
+			fmt.Println("could not close the storage", err)
+		}
+	})
+}
+
+// startSession finds peers for the torrent and starts listening for the ones
+// that find us, the peers to connect to come out of the swarm's newPeers.
+func startSession(t *Torrent, st *pieceStore, results chan *result, done <-chan struct{}) (*session, error) {
+	peers, err := getPeers(t)
+	if err != nil {
+		// we can still go on with the peers we knew about up front
+		if len(t.peers) == 0 {
+			return nil, err
+		}
+		fmt.Println("could not get peers from the tracker:", err)
 	}
 
-	buf := make([]byte, t.info.length)
-	donePieces := 0
-	for donePieces < len(t.info.pieces) {
-		res := <-results
-		offset := res.index * t.info.pieceLength
-		copy(buf[offset:], res.data)
-		donePieces++
+	active := newActivePieces()
+	sess := &session{
+		t:          t,
+		swarm:      newSwarm(),
+		store:      st,
+		extensions: newExtensionRegistry(),
+		choker:     newChoker(t.config, st),
+		active:     active,
+		picker:     newPicker(t.info, st, active, t.config.picker),
+		results:    results,
+		done:       done,
+	}
 
-		percent := float64(donePieces) / float64(len(t.info.pieces)) * 100
-		numWorkers := runtime.NumGoroutine() - 1
-		fmt.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+	for _, peer := range append(t.peers, peers...) {
+		sess.swarm.addPeer(peer)
 	}
-	close(workQueue)
 
-	return buf, nil
+	sess.registerExtensions()
+
+	// like peer exchange, local discovery is off limits for private torrents
+	if !t.info.private {
+		err = startLSD(t, sess.swarm, done)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sess.startVerifiers(runtime.NumCPU())
+	go sess.choker.run(done)
+	go sess.listenForPeers(done)
+
+	return sess, nil
 }
 
-func startWorker(torrent *Torrent, peer Peer, workQueue chan *piece, results chan *result) {
-	c, err := newClient(peer, torrent.peerID, torrent.info.infoHash)
+// registerExtensions sets up the extensions we offer to peers.
+func (sess *session) registerExtensions() {
+	// peer exchange would leak peers of private torrents past the tracker
+	if !sess.t.info.private {
+		sess.extensions.register(pexExtension(sess.swarm))
+	}
+	registerMetadataServer(sess.extensions, sess.t.info.metadata)
+}
+
+func (sess *session) startWorker(peer Peer) {
+	s := sess.swarm
+	if !s.isKnown(peer) {
+		return // it was dropped while it waited
+	}
+
+	s.acquire()
+	defer s.release()
+
+	c, err := newClient(peer, sess.t.peerID, sess.t.info.infoHash, sess.store, sess.extensions, sess.t.config.encryption)
 	if err != nil {
 		fmt.Println("could not set up the client with peer: ", peer.IP)
+		s.forget(peer)
 		return
 	}
-	defer c.conn.Close()
+	defer c.close()
+
+	// a peer that worked is worth trying again once it goes away, unless
+	// neither of us has anything left to give
+	defer func() {
+		if !sess.store.complete() || !isSeed(c.bitfield, len(sess.t.info.pieces)) {
+			s.requeue(peer, REDIALDELAY)
+		}
+	}()
 	fmt.Printf("Completed handshake with %s\n", peer.IP)
 
-	c.sendUnchoke()
+	// we dialed the peer so we know it accepts connections
+	s.connect(peer, sess.peerFlags(c)|pexReachable)
+	defer s.disconnect(peer)
+
+	sess.work(c)
+}
+
+// peerFlags are the pex flags other peers get to see for a connected peer.
+func (sess *session) peerFlags(c *client) byte {
+	flags := byte(0)
+	if isSeed(c.bitfield, len(sess.t.info.pieces)) {
+		flags |= pexSeed
+	}
+	if isEncrypted(c.conn) {
+		flags |= pexEncryption
+	}
+	if isUTP(c.conn) {
+		flags |= pexUTP
+	}
+
+	return flags
+}
+
+// work downloads pieces from the peer until the queue is closed or the
+// connection fails.
+func (sess *session) work(c *client) {
+	if c.extended {
+		err := c.sendExtendedHandshake()
+		if err != nil {
+			fmt.Println("could not send the extended handshake to", c.peer.IP)
+			return
+		}
+	}
+
+	// availability counts every connected peer
+	sess.picker.addPeer(c.bitfield)
+	defer sess.picker.removePeer(c.bitfield)
+	c.picker = sess.picker
+	c.stats = &sess.stats
+
+	go c.readLoop()
+
+	// the connection goes when the session ends
+	go func() {
+		select {
+		case <-sess.done:
+			c.conn.Close()
+		case <-c.done:
+		}
+	}()
+
+	// the choker unchokes the peer when it gets an upload slot
+	go c.serveUploads()
+	sess.choker.add(c)
+	defer sess.choker.remove(c)
+
+	if c.store.complete() {
+		// two seeds have nothing to trade
+		if isSeed(c.bitfield, len(sess.t.info.pieces)) {
+			return
+		}
+
+		serve(c)
+		return
+	}
+
 	c.sendInterested()
 
-	for p := range workQueue {
-		if !c.bitfield.HasPiece(p.index) {
-			workQueue <- p // put the piece back on the queue
+	for !sess.store.complete() {
+		// pieces a reader waits on that are late come first, we ask for
+		// their blocks like in endgame
+		ap := sess.active.latePiece(c, sess.picker)
+		endgame := ap != nil
+
+		// finish the pieces other peers started before starting new ones
+		if ap == nil {
+			ap = sess.active.partialPiece(c)
+		}
+		if ap == nil {
+			if p := sess.picker.pick(c); p != nil {
+				ap = sess.active.start(p, c)
+			}
+		}
+
+		// every piece is handed out, help finish the ones in progress
+		if ap == nil && sess.picker.remaining() == 0 {
+			ap = sess.active.endgamePiece(c)
+			endgame = true
+		}
+
+		// the peer has nothing we need right now, listen to it for a while
+		// in case it gets something
+		if ap == nil {
+			err := sess.idle(c)
+			if err != nil {
+				return
+			}
 			continue
 		}
 
-		// download the piece
-		buf, err := downloadPiece(c, p)
+		err := sess.downloadPiece(c, ap, endgame)
 		if err != nil {
 			fmt.Println("exiting", err)
-			workQueue <- p
 			return
 		}
+	}
 
-		if !checkIntegrity(p, buf) {
-			fmt.Println("the received piece hash did not match expected")
-			workQueue <- p
-			continue
-		}
-
-		c.sendHave(p.index)
-		results <- &result{p.index, buf}
+	// we're done but the peer may not be, keep uploading to it
+	if !isSeed(c.bitfield, len(sess.t.info.pieces)) {
+		serve(c)
 	}
 }
 
-func (ps *pieceState) read() error {
-	msg, err := ps.c.read()
-	if err != nil {
-		return err
+// idle handles the messages of the peer for a second while we have nothing
+// to download from it.
+func (sess *session) idle(c *client) error {
+	select {
+	case msg, ok := <-c.incoming:
+		if !ok {
+			return c.readError()
+		}
+		return c.handleMessage(msg)
+	case <-time.After(time.Second):
+		return nil
 	}
+}
 
+// handleMessage handles the messages that don't depend on the piece we are
+// downloading from the peer.
+func (c *client) handleMessage(msg *Message) error {
 	if msg == nil { // Keep alive
 		return nil
 	}
 
 	switch msg.ID {
 	case MsgUnchoke:
-		ps.c.choked = false
+		c.choked = false
 	case MsgChoke:
-		ps.c.choked = true
+		c.choked = true
 	case MsgHave:
-		pieceIdx := 0
-		for _, b := range msg.Payload {
-			pieceIdx = pieceIdx << 8
-			pieceIdx |= int(b)
+		index, err := parseIndex(msg.Payload)
+		if err != nil {
+			return err
 		}
+		if !c.bitfield.HasPiece(index) {
+			c.bitfield.SetPiece(index)
+			if c.picker != nil && c.bitfield.HasPiece(index) {
+				c.picker.have(index)
+			}
+		}
+	case MsgSuggest:
+		index, err := parseIndex(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.suggested[index] = true
+	case MsgAllowedFast:
+		index, err := parseIndex(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.allowedFast[index] = true
+	case MsgInterested, MsgNotInterested, MsgRequest, MsgCancel:
+		return c.handleUploadMessage(msg)
+	case MsgExtended:
+		return c.handleExtended(msg.Payload)
+	}
+
+	return nil
+}
 
-		ps.c.bitfield.SetPiece(pieceIdx)
+func (ps *pieceState) handle(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	ap, index := ps.ap, ps.ap.p.index
+
+	switch msg.ID {
+	case MsgChoke:
+		// without the fast extension a choke silently drops our requests,
+		// with it the peer rejects each one it won't answer
+		if !ps.c.fast {
+			ps.sess.active.dropAll(ap, ps.c)
+		}
 	case MsgPiece:
 		if len(msg.Payload) < 8 {
 			return errors.New("The piece message was to short.")
 		}
 
-		index := binary.BigEndian.Uint32(msg.Payload[:4])
-		if index != uint32(ps.index) {
-			return errors.New("the received piece index did not match the expected")
+		if int(binary.BigEndian.Uint32(msg.Payload[:4])) != index {
+			return nil // a late block of a piece we already finished
+		}
+
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		block := msg.Payload[8:]
+		if begin+len(block) > ap.p.length {
+			return errors.New("the received block does not fit in the piece")
+		}
+
+		ps.sess.stats.downloaded.Add(int64(len(block)))
+		ps.c.mu.Lock()
+		ps.c.downloaded += len(block)
+		ps.c.lastPiece = time.Now()
+		ps.c.mu.Unlock()
+
+		others, complete := ps.sess.active.receive(ap, ps.c, begin, block)
+		// in endgame the other peers we asked for the block can stop
+		for _, other := range others {
+			other.sendCancel(index, begin, len(block))
+		}
+		ps.sess.active.hashBlocks(ap)
+
+		if complete {
+			ps.sess.queueVerify(ap)
+		}
+
+		return nil
+	case MsgRejectRequest:
+		if len(msg.Payload) < 12 {
+			return errors.New("the reject message was to short")
 		}
 
-		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
-		copy(ps.buf[begin:], msg.Payload[8:])
+		if int(binary.BigEndian.Uint32(msg.Payload[:4])) == index {
+			ps.sess.active.drop(ap, ps.c, int(binary.BigEndian.Uint32(msg.Payload[4:8])))
+		}
 
-		ps.downloaded += len(msg.Payload) - 8
-		ps.backlog--
+		return nil
 	}
 
-	return nil
+	return ps.c.handleMessage(msg)
 }
 
-func downloadPiece(c *client, p *piece) ([]byte, error) {
+// downloadPiece requests blocks of the piece until it is verified or there is
+// nothing left for us to ask for.
+func (sess *session) downloadPiece(c *client, ap *activePiece, endgame bool) error {
 	state := pieceState{
-		c:          c,
-		buf:        make([]byte, p.length),
-		index:      p.index,
-		downloaded: 0,
-		backlog:    0,
-		requested:  0,
+		sess: sess,
+		c:    c,
+		ap:   ap,
 	}
 
-	c.conn.SetDeadline(time.Now().Add(45 * time.Second))
-	defer c.conn.SetDeadline(time.Time{})
-
-	for state.downloaded < p.length {
-		if !state.c.choked {
-			for state.backlog < MAXBACKLOG && state.requested < p.length {
-				// request a block
-				blocksize := MAXBLOCKSIZE // 16 kb is the normal block size
-
-				if p.length-state.requested < blocksize {
-					blocksize = p.length - state.requested
+	defer func() {
+		// nobody else is working on the piece, someone else has to get it
+		if sess.active.leave(ap, c) {
+			sess.picker.putBack(ap.p)
+		}
+	}()
+
+	// wake up now and then to pick up requests that timed out
+	ticker := time.NewTicker(BLOCKTIMEOUT / 4)
+	defer ticker.Stop()
+
+	for !ap.finished() {
+		// pieces in the allowed fast set can be requested while choked
+		if !c.choked || c.allowedFast[ap.p.index] {
+			for sess.active.numPending(ap, c) < c.maxBacklog() {
+				begin, ok := sess.active.nextBlock(ap, c, endgame)
+				if !ok {
+					break
 				}
 
-				err := c.sendRequest(p.index, state.requested, blocksize)
+				err := c.sendRequest(ap.p.index, begin, blockSize(ap.p.length, begin))
 				if err != nil {
-					return nil, err
+					return err
 				}
+			}
 
-				state.backlog++
-				state.requested += blocksize
+			// the rest of the blocks are with other peers, go find more work
+			if sess.active.numPending(ap, c) == 0 {
+				return nil
 			}
 		}
 
-		err := state.read()
-		if err != nil {
-			return nil, err
+		select {
+		case msg, ok := <-c.incoming:
+			if !ok {
+				return c.readError()
+			}
+
+			err := state.handle(msg)
+			if err != nil {
+				return err
+			}
+		case <-ap.done:
+		case <-ticker.C:
+			c.mu.Lock()
+			stalled := time.Since(c.lastPiece) > STALLTIMEOUT
+			c.mu.Unlock()
+
+			if stalled && sess.active.numPending(ap, c) > 0 {
+				return errors.New("the peer stopped sending blocks")
+			}
 		}
 	}
 
-	return state.buf, nil
+	return nil
+}
+
+// blockSize is the size of the block starting at begin, 16 kb is the normal
+// block size but the last block of a piece can be shorter.
+func blockSize(pieceLength, begin int) int {
+	blocksize := MAXBLOCKSIZE
+	if pieceLength-begin < blocksize {
+		blocksize = pieceLength - begin
+	}
+
+	return blocksize
 }
 
 func checkIntegrity(p *piece, buf []byte) bool {
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testSession sets up a session for the torrent without trackers, listeners
+// or discovery, peers are connected by hand with connectSessions.
+func testSession(t testing.TB, info *TorrentFile, st *pieceStore) *session {
+	config := defaultConfig()
+	config.rechokeInterval = 10 * time.Millisecond
+	config.dir = t.TempDir()
+
+	torrent := &Torrent{info: info, config: config}
+	torrent.peerID[0] = byte(rand.Intn(256))
+
+	active := newActivePieces()
+	sess := &session{
+		t:          torrent,
+		swarm:      newSwarm(),
+		store:      st,
+		extensions: newExtensionRegistry(),
+		choker:     newChoker(config, st),
+		active:     active,
+		picker:     newPicker(info, st, active, config.picker),
+		results:    make(chan *result),
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	sess.done = done
+	sess.startVerifiers(runtime.NumCPU())
+	go sess.choker.run(done)
+
+	return sess
+}
+
+// connectSessions runs a connection between the two sessions over loopback
+// tcp, a pipe has no buffer for both sides sending their bitfield at once.
+func connectSessions(t *testing.T, dialer, listener *session) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("could not accept: %s", err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	infoHash := dialer.t.info.infoHash
+	go func() {
+		h, err := answerHandshake(b, infoHash, listener.t.peerID)
+		if err != nil {
+			return
+		}
+		c, err := setupClient(b, h, Peer{IP: net.IPv4(127, 0, 0, 2), Port: 1}, listener.t.peerID, infoHash, listener.store, listener.extensions)
+		if err != nil {
+			return
+		}
+		defer c.close()
+		listener.work(c)
+	}()
+
+	go func() {
+		h, err := completeHandshake(a, infoHash, dialer.t.peerID)
+		if err != nil {
+			return
+		}
+		c, err := setupClient(a, h, Peer{IP: net.IPv4(127, 0, 0, 1), Port: 1}, dialer.t.peerID, infoHash, dialer.store, dialer.extensions)
+		if err != nil {
+			return
+		}
+		defer c.close()
+		dialer.work(c)
+	}()
+}
+
+func waitForPieces(t *testing.T, sess *session) {
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < len(sess.t.info.pieces); i++ {
+		select {
+		case <-sess.results:
+		case <-timeout:
+			t.Fatalf("timed out after %d pieces", i)
+		}
+	}
+}
+
+func TestDownloadFromSeed(t *testing.T) {
+	data := make([]byte, 5*32768+1000)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+
+	seedStore, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	seed := testSession(t, info, seedStore)
+	leech := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+
+	connectSessions(t, leech, seed)
+	waitForPieces(t, leech)
+
+	if !bytes.Equal(storeBytes(t, leech.store), data) {
+		t.Fatalf("the downloaded data does not match")
+	}
+}
+
+func TestEndgameWithTwoSeeds(t *testing.T) {
+	data := make([]byte, 3*32768)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+
+	leech := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+	for i := 0; i < 2; i++ {
+		st, err := loadPieceStore(info, newMemoryStorage(info, data))
+		if err != nil {
+			t.Fatalf("could not load the store: %s", err)
+		}
+		connectSessions(t, leech, testSession(t, info, st))
+	}
+	waitForPieces(t, leech)
+
+	if !bytes.Equal(storeBytes(t, leech.store), data) {
+		t.Fatalf("the downloaded data does not match")
+	}
+}
+
+func TestHaveReachesEveryPeer(t *testing.T) {
+	data := make([]byte, 3*32768)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+
+	seedStore, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	leech := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+	third := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+
+	// the third peer only knows the leech, and the leech has nothing yet,
+	// so it can only get pieces after hearing the leech got them
+	connectSessions(t, third, leech)
+	connectSessions(t, leech, testSession(t, info, seedStore))
+
+	waitForPieces(t, leech)
+	waitForPieces(t, third)
+
+	if !bytes.Equal(storeBytes(t, third.store), data) {
+		t.Fatalf("the data passed on by the leech does not match")
+	}
+}
+
+func TestIncomingPeersTakeSlots(t *testing.T) {
+	data := make([]byte, 2*32768)
+	info := testTorrent(data, 32768)
+	st, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	sess := testSession(t, info, st)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer ln.Close()
+
+	dial := func() net.Conn {
+		a, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("could not dial: %s", err)
+		}
+		b, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("could not accept: %s", err)
+		}
+		t.Cleanup(func() { a.Close(); b.Close() })
+
+		go sess.handleIncoming(b)
+		return a
+	}
+
+	first := dial()
+	_, err = completeHandshake(first, info.infoHash, [20]byte{1})
+	if err != nil {
+		t.Fatalf("could not handshake: %s", err)
+	}
+	bitfield := Message{ID: MsgBitfield, Payload: make([]byte, 1)}
+	first.Write(bitfield.serialize())
+
+	// the peer shows up like the ones we dial, to pex as well
+	deadline := time.Now().Add(time.Second)
+	for sess.swarm.numConnected() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the incoming peer to be connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sp := sess.swarm.connectedPeers()[0]; sp.flags&pexReachable != 0 {
+		t.Fatalf("expected an incoming peer not to be marked reachable")
+	}
+
+	// once every slot is taken the next one is turned away
+	for i := 1; i < MAXPEERS; i++ {
+		sess.swarm.acquire()
+	}
+	second := dial()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if err == nil || os.IsTimeout(err) {
+		t.Fatalf("expected the connection to be closed, got=%v", err)
+	}
+
+	first.Close()
+	deadline = time.Now().Add(time.Second)
+	for sess.swarm.numConnected() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the peer to be gone after it disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
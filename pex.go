@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+const extPexName = "ut_pex"
+
+const (
+	PEXINTERVAL = time.Minute // BEP 11 asks for at most one message a minute
+	PEXMAXPEERS = 50          // max added and dropped peers in one message
+)
+
+// Flags sent next to every added peer
+const (
+	pexEncryption byte = 0x01
+	pexSeed       byte = 0x02
+	pexUTP        byte = 0x04
+	pexHolepunch  byte = 0x08
+	pexReachable  byte = 0x10
+)
+
+type pexState struct {
+	swarm    *swarm
+	mu       sync.Mutex
+	sent     map[string]Peer // the peers this connection has been told about
+	lastRecv time.Time
+}
+
+func newPexState(s *swarm) *pexState {
+	return &pexState{
+		swarm: s,
+		sent:  make(map[string]Peer),
+	}
+}
+
+// pexExtension plugs peer exchange into the extension protocol, peers we
+// learn about are handed to the swarm.
+func pexExtension(s *swarm) *extensionHandler {
+	return &extensionHandler{
+		name: extPexName,
+		handshake: func(c *client, hs *extendedHandshake) error {
+			if c.pex != nil || hs.m[extPexName] == 0 {
+				return nil
+			}
+
+			c.pex = newPexState(s)
+			go c.startPex()
+
+			return nil
+		},
+		handle: func(c *client, payload []byte) error {
+			if c.pex == nil {
+				return nil // they never told us they do pex
+			}
+
+			dict, err := decodeDict(payload)
+			if err != nil {
+				return err
+			}
+
+			return c.pex.handle(dict)
+		},
+	}
+}
+
+// startPex sends our list of connected peers to the peer every PEXINTERVAL
+// until the connection is closed.
+func (c *client) startPex() {
+	ticker := time.NewTicker(PEXINTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			err := c.sendPex()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *client) sendPex() error {
+	id := c.extensionID(extPexName)
+	if id == 0 {
+		return nil // the peer doesn't do pex, or hasn't told us yet
+	}
+
+	msg := c.pex.message(c.peer)
+	if msg == nil {
+		return nil
+	}
+
+	return c.sendExtended(id, msg)
+}
+
+// message builds the next pex message for the peer at self: the connected
+// peers it wasn't told about yet and the ones that went away since. It
+// returns nil when nothing changed.
+func (p *pexState) message(self Peer) bencode.Dictionary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]swarmPeer)
+	for _, sp := range p.swarm.connectedPeers() {
+		addr := sp.peer.String()
+		if addr == self.String() {
+			continue
+		}
+		current[addr] = sp
+	}
+
+	added := Peers{}
+	addedFlags := []byte{}
+	for addr, sp := range current {
+		if len(added) >= PEXMAXPEERS {
+			break
+		}
+		if _, ok := p.sent[addr]; ok {
+			continue
+		}
+		added = append(added, sp.peer)
+		addedFlags = append(addedFlags, sp.flags)
+	}
+
+	dropped := Peers{}
+	for addr, peer := range p.sent {
+		if len(dropped) >= PEXMAXPEERS {
+			break
+		}
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		dropped = append(dropped, peer)
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	// the flags are split the same way the peers are
+	var flags4, flags6 []byte
+	for i, peer := range added {
+		if peer.IP.To4() != nil {
+			flags4 = append(flags4, addedFlags[i])
+		} else {
+			flags6 = append(flags6, addedFlags[i])
+		}
+	}
+
+	added4, added6 := serializePeers(added)
+	dropped4, dropped6 := serializePeers(dropped)
+
+	// if sending it fails the connection is gone along with this state
+	for _, peer := range added {
+		p.sent[peer.String()] = peer
+	}
+	for _, peer := range dropped {
+		delete(p.sent, peer.String())
+	}
+
+	return bencode.Dictionary{
+		"added":    added4,
+		"added.f":  flags4,
+		"added6":   added6,
+		"added6.f": flags6,
+		"dropped":  dropped4,
+		"dropped6": dropped6,
+	}
+}
+
+// handle feeds the peers of a pex message we got into the swarm.
+func (p *pexState) handle(dict bencode.Dictionary) error {
+	p.mu.Lock()
+	// peers should stick to one message a minute, what the faster ones add
+	// is ignored
+	flood := !p.lastRecv.IsZero() && time.Since(p.lastRecv) < PEXINTERVAL/2
+	if !flood {
+		p.lastRecv = time.Now()
+	}
+	p.mu.Unlock()
+
+	// the peer lost them, no use dialing them unless somebody else brings
+	// them up again
+	dropped, err := pexPeers(dict, "dropped", "dropped6")
+	if err != nil {
+		return err
+	}
+	for _, peer := range dropped {
+		p.swarm.dropped(peer)
+	}
+
+	if flood {
+		return nil
+	}
+
+	added, err := pexPeers(dict, "added", "added6")
+	if err != nil {
+		return err
+	}
+	for _, peer := range added {
+		p.swarm.addPeer(peer)
+	}
+
+	return nil
+}
+
+// pexPeers reads the v4 and v6 peer lists under the keys, at most
+// PEXMAXPEERS of each.
+func pexPeers(dict bencode.Dictionary, key4, key6 string) (Peers, error) {
+	peers := Peers{}
+	for _, key := range []string{key4, key6} {
+		data, ok := dict[key].([]byte)
+		if !ok {
+			continue
+		}
+
+		var list Peers
+		var err error
+		if key == key4 {
+			list, err = deserializePeers(data)
+		} else {
+			list, err = deserializePeers6(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(list) > PEXMAXPEERS {
+			list = list[:PEXMAXPEERS]
+		}
+		peers = append(peers, list...)
+	}
+
+	return peers, nil
+}
+
+func isSeed(bf Bitfield, numPieces int) bool {
+	for i := 0; i < numPieces; i++ {
+		if !bf.HasPiece(i) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+var pexSelf = Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+// readPex builds the next pex message and returns the peers it added with
+// their flags and the peers it dropped.
+func readPex(t *testing.T, p *pexState) (map[string]byte, map[string]bool) {
+	t.Helper()
+
+	dict := p.message(pexSelf)
+	if dict == nil {
+		t.Fatalf("expected a pex message")
+	}
+
+	added := map[string]byte{}
+	for _, key := range []string{"added", "added6"} {
+		var peers Peers
+		var err error
+		if key == "added" {
+			peers, err = deserializePeers(dict[key].([]byte))
+		} else {
+			peers, err = deserializePeers6(dict[key].([]byte))
+		}
+		if err != nil {
+			t.Fatalf("could not parse %s: %s", key, err)
+		}
+
+		flags := dict[key+".f"].([]byte)
+		if len(flags) != len(peers) {
+			t.Fatalf("expected a flag for every peer in %s, got=%d for %d", key, len(flags), len(peers))
+		}
+		for i, peer := range peers {
+			added[peer.String()] = flags[i]
+		}
+	}
+
+	dropped := map[string]bool{}
+	dropped4, _ := deserializePeers(dict["dropped"].([]byte))
+	dropped6, _ := deserializePeers6(dict["dropped6"].([]byte))
+	for _, peer := range append(dropped4, dropped6...) {
+		dropped[peer.String()] = true
+	}
+
+	return added, dropped
+}
+
+func TestPexAddedAndDropped(t *testing.T) {
+	s := newSwarm()
+	p := newPexState(s)
+
+	a := Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	b := Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	d := Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6882}
+	e := Peer{IP: net.ParseIP("2001:db8::2"), Port: 6882}
+
+	s.connect(pexSelf, pexReachable) // the peer itself is never sent
+	s.connect(a, pexSeed)
+	s.connect(b, pexUTP)
+	s.connect(d, pexReachable)
+	s.connect(e, pexEncryption|pexSeed)
+
+	added, dropped := readPex(t, p)
+	expected := map[string]byte{
+		a.String(): pexSeed,
+		b.String(): pexUTP,
+		d.String(): pexReachable,
+		e.String(): pexEncryption | pexSeed,
+	}
+	if len(added) != len(expected) || len(dropped) != 0 {
+		t.Fatalf("expected %d added and none dropped, got=%v %v", len(expected), added, dropped)
+	}
+	for addr, flags := range expected {
+		if added[addr] != flags {
+			t.Fatalf("expected %s with flags %#x, got=%#x", addr, flags, added[addr])
+		}
+	}
+
+	// the next message only has what changed
+	s.disconnect(a)
+	s.disconnect(e)
+	f := Peer{IP: net.ParseIP("2001:db8::3"), Port: 6883}
+	s.connect(f, pexUTP|pexReachable)
+
+	added, dropped = readPex(t, p)
+	if len(added) != 1 || added[f.String()] != pexUTP|pexReachable {
+		t.Fatalf("expected only %s to be added, got=%v", f, added)
+	}
+	if len(dropped) != 2 || !dropped[a.String()] || !dropped[e.String()] {
+		t.Fatalf("expected %s and %s to be dropped, got=%v", a, e, dropped)
+	}
+
+	if p.message(pexSelf) != nil {
+		t.Fatalf("expected no message when nothing changed")
+	}
+}
+
+func TestPexMaxPeers(t *testing.T) {
+	s := newSwarm()
+	p := newPexState(s)
+
+	var peers Peers
+	for i := 0; i < PEXMAXPEERS+10; i++ {
+		peer := Peer{IP: net.IPv4(10, 1, byte(i/256), byte(i%256)), Port: 6881}
+		peers = append(peers, peer)
+		s.connect(peer, 0)
+	}
+
+	// what doesn't fit goes out with the next message
+	added, _ := readPex(t, p)
+	if len(added) != PEXMAXPEERS {
+		t.Fatalf("expected %d peers to be added, got=%d", PEXMAXPEERS, len(added))
+	}
+	added, _ = readPex(t, p)
+	if len(added) != 10 {
+		t.Fatalf("expected the other 10 peers to be added, got=%d", len(added))
+	}
+
+	// and we don't take more than that from others
+	other := newSwarm()
+	added4, _ := serializePeers(peers)
+	err := newPexState(other).handle(bencode.Dictionary{"added": added4})
+	if err != nil {
+		t.Fatalf("could not handle pex: %s", err)
+	}
+	if len(other.newPeers) != PEXMAXPEERS {
+		t.Fatalf("expected %d peers to be taken, got=%d", PEXMAXPEERS, len(other.newPeers))
+	}
+}
+
+func TestPexRateLimit(t *testing.T) {
+	s := newSwarm()
+	p := newPexState(s)
+
+	msg := func(peer Peer) bencode.Dictionary {
+		added4, _ := serializePeers(Peers{peer})
+		return bencode.Dictionary{"added": added4}
+	}
+
+	p.handle(msg(Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}))
+	// the second one comes too soon after the first
+	p.handle(msg(Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6881}))
+	if len(s.newPeers) != 1 {
+		t.Fatalf("expected one peer to be added, got=%d", len(s.newPeers))
+	}
+
+	p.lastRecv = time.Now().Add(-PEXINTERVAL)
+	p.handle(msg(Peer{IP: net.IPv4(10, 0, 0, 4), Port: 6881}))
+	if len(s.newPeers) != 2 {
+		t.Fatalf("expected the peer to be added after a minute, got=%d", len(s.newPeers))
+	}
+}
+
+func TestPexDropped(t *testing.T) {
+	s := newSwarm()
+	p := newPexState(s)
+
+	gone := Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	ours := Peer{IP: net.IPv4(10, 0, 0, 3), Port: 6881}
+	s.addPeer(gone)
+	s.addPeer(ours)
+	s.connect(ours, pexReachable)
+
+	// dropped peers are taken even from a message that comes too soon
+	p.lastRecv = time.Now()
+	dropped4, _ := serializePeers(Peers{gone, ours})
+	p.handle(bencode.Dictionary{"dropped": dropped4})
+
+	if s.isKnown(gone) {
+		t.Fatalf("expected the dropped peer to be forgotten")
+	}
+	if !s.isKnown(ours) {
+		t.Fatalf("expected a peer we are connected to to be kept")
+	}
+}
+
+func TestPexOverExtension(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+
+	s := newSwarm()
+	c := &client{
+		conn:           ours,
+		peer:           pexSelf,
+		peerExtensions: map[string]int{extPexName: 5},
+		pex:            newPexState(s),
+	}
+
+	peer := Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	s.connect(peer, pexSeed)
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.sendPex() }()
+
+	msg, err := readMessage(theirs)
+	if err != nil {
+		t.Fatalf("could not read the pex message: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("could not send pex: %s", err)
+	}
+	// it goes out with the id the peer asked for
+	if msg.ID != MsgExtended || msg.Payload[0] != 5 {
+		t.Fatalf("expected an extended message with id 5, got=%d %d", msg.ID, msg.Payload[0])
+	}
+
+	dict, err := decodeDict(msg.Payload[1:])
+	if err != nil {
+		t.Fatalf("could not decode the pex message: %s", err)
+	}
+	added, _ := deserializePeers(dict["added"].([]byte))
+	if len(added) != 1 || added[0].String() != peer.String() {
+		t.Fatalf("expected %s to be added, got=%v", peer, added)
+	}
+}
+
+func TestPexPrivate(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		sess := &session{
+			t:          &Torrent{info: &TorrentFile{private: private}},
+			swarm:      newSwarm(),
+			extensions: newExtensionRegistry(),
+		}
+		sess.registerExtensions()
+
+		registered := false
+		for _, h := range sess.extensions.handlers {
+			if h.name == extPexName {
+				registered = true
+			}
+		}
+		if registered == private {
+			t.Fatalf("expected pex to be registered only for public torrents, private=%t registered=%t", private, registered)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RANDOMPIECES is how many pieces RarestFirst picks at random before going
+// rarest first, the rarest pieces are slow to get and we want something to
+// trade quickly.
+const RANDOMPIECES = 4
+
+// PieceCandidate is a piece we could download from a peer.
+type PieceCandidate struct {
+	Index        int
+	Availability int  // connected peers that have the piece
+	Started      bool // we have some of its blocks already
+	Preferred    bool // the peer suggested it or lets us have it while choked
+}
+
+// PiecePicker decides the order pieces are downloaded in. Pick gets the
+// number of pieces we have and the pieces the peer can give us that nobody
+// is working on, sorted by index, and returns the index of the piece to
+// download next. It is called from every worker, so it has to be safe for
+// concurrent use.
+type PiecePicker interface {
+	Pick(have int, candidates []PieceCandidate) (int, bool)
+}
+
+// PiecePickerFunc lets an ordinary function be a PiecePicker.
+type PiecePickerFunc func(have int, candidates []PieceCandidate) (int, bool)
+
+func (f PiecePickerFunc) Pick(have int, candidates []PieceCandidate) (int, bool) {
+	return f(have, candidates)
+}
+
+// RarestFirst picks what the peer pointed us at, then pieces other workers
+// left half done, then the piece the fewest peers have, which keeps pieces
+// from dying out of the swarm. The first few pieces are random.
+type RarestFirst struct{}
+
+func (RarestFirst) Pick(have int, candidates []PieceCandidate) (int, bool) {
+	random := have < RANDOMPIECES
+
+	best, bestRank, ties := -1, 0, 0
+	for _, cand := range candidates {
+		// a lower rank is better
+		rank := cand.Availability + 2
+		if random {
+			rank = 2
+		}
+		if cand.Started {
+			rank = 1
+		}
+		if cand.Preferred {
+			rank = 0
+		}
+
+		switch {
+		case best < 0 || rank < bestRank:
+			best, bestRank, ties = cand.Index, rank, 1
+		case rank == bestRank:
+			// pick one of the equally good pieces at random so peers don't
+			// all go after the same one
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = cand.Index
+			}
+		}
+	}
+
+	return best, best >= 0
+}
+
+// Sequential picks the piece with the lowest index.
+type Sequential struct{}
+
+func (Sequential) Pick(have int, candidates []PieceCandidate) (int, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	return candidates[0].Index, true
+}
+
+// picker keeps the books for the PiecePicker of a torrent. It counts how many
+// connected peers have each piece from their bitfields and have messages and
+// tracks the pieces no worker has taken yet.
+type picker struct {
+	mu           sync.Mutex
+	info         *TorrentFile
+	store        *pieceStore
+	active       *activePieces
+	strategy     PiecePicker
+	availability []int
+	wanted       map[int]bool // pieces we don't have that no worker has taken
+
+	// pieces readers are blocked on go before whatever the strategy picks,
+	// the lock is separate since the active pieces ask for deadlines
+	urgentMu sync.Mutex
+	urgent   map[int]time.Time
+}
+
+func newPicker(info *TorrentFile, st *pieceStore, active *activePieces, strategy PiecePicker) *picker {
+	p := &picker{
+		info:         info,
+		store:        st,
+		active:       active,
+		strategy:     strategy,
+		availability: make([]int, len(info.pieces)),
+		wanted:       make(map[int]bool),
+		urgent:       make(map[int]time.Time),
+	}
+
+	for index := range info.pieces {
+		if !st.hasPiece(index) {
+			p.wanted[index] = true
+		}
+	}
+
+	return p
+}
+
+func (p *picker) addPeer(bf Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]++
+		}
+	}
+}
+
+func (p *picker) removePeer(bf Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]--
+		}
+	}
+}
+
+// have counts a piece a peer announced with a have message.
+func (p *picker) have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// pick takes the piece the worker of c should download next off the wanted
+// list, or returns nil if the peer has none of them. The strategy of the
+// torrent decides between the pieces the peer has.
+func (p *picker) pick(c *client) *piece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := []PieceCandidate{}
+	for index := range p.wanted {
+		if !c.bitfield.HasPiece(index) {
+			continue
+		}
+
+		candidates = append(candidates, PieceCandidate{
+			Index:        index,
+			Availability: p.availability[index],
+			Started:      p.active.started(index),
+			Preferred:    c.prefers(index),
+		})
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// the map gives us the candidates in random order, sort them so a
+	// strategy only has to break ties itself if it wants to
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Index < candidates[j].Index
+	})
+
+	index, ok := p.pickUrgent(candidates)
+	if !ok {
+		index, ok = p.strategy.Pick(p.store.count(), candidates)
+	}
+	if !ok || !p.wanted[index] || !c.bitfield.HasPiece(index) {
+		return nil
+	}
+
+	delete(p.wanted, index)
+	delete(c.suggested, index)
+
+	return &piece{index, p.info.pieces[index], p.info.pieceSize(index)}
+}
+
+func (p *picker) pickUrgent(candidates []PieceCandidate) (int, bool) {
+	p.urgentMu.Lock()
+	defer p.urgentMu.Unlock()
+
+	best, ok := 0, false
+	for _, cand := range candidates {
+		deadline, urgent := p.urgent[cand.Index]
+		if urgent && (!ok || deadline.Before(p.urgent[best])) {
+			best, ok = cand.Index, true
+		}
+	}
+
+	return best, ok
+}
+
+// prioritize makes the piece go before all others, it is late once the
+// deadline passes.
+func (p *picker) prioritize(index int, deadline time.Time) {
+	p.urgentMu.Lock()
+	defer p.urgentMu.Unlock()
+
+	if old, ok := p.urgent[index]; !ok || deadline.Before(old) {
+		p.urgent[index] = deadline
+	}
+}
+
+// done forgets the priority of a piece we got.
+func (p *picker) done(index int) {
+	p.urgentMu.Lock()
+	defer p.urgentMu.Unlock()
+
+	delete(p.urgent, index)
+}
+
+// Deadline is when a reader or the strategy wants the piece by.
+func (p *picker) Deadline(index int) (time.Time, bool) {
+	p.urgentMu.Lock()
+	deadline, ok := p.urgent[index]
+	p.urgentMu.Unlock()
+	if ok {
+		return deadline, true
+	}
+
+	if d, ok := p.strategy.(deadliner); ok {
+		return d.Deadline(index)
+	}
+
+	return time.Time{}, false
+}
+
+// putBack returns a piece nobody is working on anymore to the wanted list.
+func (p *picker) putBack(pc *piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.wanted[pc.index] = true
+}
+
+// remaining is the number of pieces no worker has taken yet.
+func (p *picker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.wanted)
+}
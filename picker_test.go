@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPickRarestFirst(t *testing.T) {
+	info := testTorrent(make([]byte, 8*MAXBLOCKSIZE), MAXBLOCKSIZE)
+	st := newPieceStore(info, newMemoryStorage(info, nil))
+	// past the random first pieces
+	for index := 0; index < RANDOMPIECES; index++ {
+		st.writePiece(index, make([]byte, MAXBLOCKSIZE))
+	}
+
+	active := newActivePieces()
+	p := newPicker(info, st, active, RarestFirst{})
+
+	common := fullBitfield(8)
+	p.addPeer(common)
+	p.addPeer(common)
+	rare := newBitfield(8)
+	rare.SetPiece(6)
+	p.addPeer(rare)
+	p.have(5)
+	p.have(7)
+	p.have(7)
+
+	c := &client{bitfield: fullBitfield(8), suggested: make(map[int]bool)}
+	if got := p.pick(c); got == nil || got.index != 4 {
+		t.Fatalf("expected the rarest piece 4, got=%v", got)
+	}
+
+	// a piece someone left half done goes before rarer ones
+	started := active.start(&piece{index: 7, length: MAXBLOCKSIZE}, &client{})
+	started.received[0] = true
+	if got := p.pick(c); got == nil || got.index != 7 {
+		t.Fatalf("expected the started piece 7, got=%v", got)
+	}
+
+	// and what the peer suggests goes before anything
+	c.suggested[6] = true
+	if got := p.pick(c); got == nil || got.index != 6 {
+		t.Fatalf("expected the suggested piece 6, got=%v", got)
+	}
+
+	p.removePeer(common)
+	if p.availability[5] != 2 {
+		t.Fatalf("expected piece 5 to be on 2 peers, got=%d", p.availability[5])
+	}
+
+	if p.pick(&client{bitfield: newBitfield(8)}) != nil {
+		t.Fatalf("expected nothing for a peer without pieces")
+	}
+}
+
+func TestPickStrategies(t *testing.T) {
+	info := testTorrent(make([]byte, 4*MAXBLOCKSIZE), MAXBLOCKSIZE)
+	c := &client{bitfield: fullBitfield(4), suggested: make(map[int]bool)}
+
+	p := newPicker(info, newPieceStore(info, newMemoryStorage(info, nil)), newActivePieces(), Sequential{})
+	for want := 0; want < 4; want++ {
+		if got := p.pick(c); got == nil || got.index != want {
+			t.Fatalf("expected piece %d, got=%v", want, got)
+		}
+	}
+
+	// a custom picker going from the back
+	last := PiecePickerFunc(func(have int, candidates []PieceCandidate) (int, bool) {
+		return candidates[len(candidates)-1].Index, true
+	})
+	p = newPicker(info, newPieceStore(info, newMemoryStorage(info, nil)), newActivePieces(), last)
+	if got := p.pick(c); got == nil || got.index != 3 {
+		t.Fatalf("expected piece 3, got=%v", got)
+	}
+
+	// picking a piece that wasn't offered gets nothing
+	bogus := PiecePickerFunc(func(have int, candidates []PieceCandidate) (int, bool) {
+		return 99, true
+	})
+	p = newPicker(info, newPieceStore(info, newMemoryStorage(info, nil)), newActivePieces(), bogus)
+	if got := p.pick(c); got != nil {
+		t.Fatalf("expected no piece, got=%v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var errTransferClosed = errors.New("the transfer was closed")
+
+// Reader reads the content of a torrent, or one of its files, while it
+// downloads. The pieces under the read position go before every other piece
+// and reads block until they are in and verified.
+type Reader struct {
+	tr     *Transfer
+	ctx    context.Context
+	pos    int64
+	start  int64 // where the content we read starts in the torrent
+	length int64
+}
+
+// NewReader returns a Reader over all of the content, reads give up with the
+// error of ctx once it is done.
+func (tr *Transfer) NewReader(ctx context.Context) *Reader {
+	return &Reader{
+		tr:     tr,
+		ctx:    ctx,
+		length: int64(tr.sess.t.info.length),
+	}
+}
+
+// NewFileReader returns a Reader over the file at index in the torrent.
+func (tr *Transfer) NewFileReader(ctx context.Context, index int) *Reader {
+	f := tr.sess.t.info.files[index]
+
+	return &Reader{
+		tr:     tr,
+		ctx:    ctx,
+		start:  int64(f.offset),
+		length: int64(f.length),
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	// get the pieces after the read ahead of time, sequential reads want
+	// them next
+	r.readAhead(r.pos + int64(len(p)))
+
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+
+	return n, err
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.length {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > r.length {
+		end = r.length
+	}
+
+	info, picker := r.tr.sess.t.info, r.tr.sess.picker
+	first := int((r.start + off) / int64(info.pieceLength))
+	last := int((r.start + end - 1) / int64(info.pieceLength))
+
+	now := time.Now()
+	for index := first; index <= last; index++ {
+		if !r.tr.sess.store.hasPiece(index) {
+			picker.prioritize(index, now.Add(time.Duration(index-first+1)*STREAMPIECETIME))
+		}
+	}
+
+	for index := first; index <= last; index++ {
+		err := r.wait(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.tr.sess.store.readAt(p[:end-off], r.start+off)
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+
+	return pos, nil
+}
+
+// readAhead prioritizes the window of pieces after off, after the ones a
+// read blocks on. It stops at the end of what the reader covers, the pieces
+// of the next file aren't wanted yet.
+func (r *Reader) readAhead(off int64) {
+	info, picker := r.tr.sess.t.info, r.tr.sess.picker
+	if off >= r.length {
+		return
+	}
+
+	first := int((r.start + off) / int64(info.pieceLength))
+	last := int((r.start + r.length - 1) / int64(info.pieceLength))
+	now := time.Now()
+	for i := 0; i < STREAMWINDOW && first+i <= last; i++ {
+		if !r.tr.sess.store.hasPiece(first + i) {
+			picker.prioritize(first+i, now.Add(time.Duration(i+2)*STREAMPIECETIME))
+		}
+	}
+}
+
+// wait blocks until we have the piece.
+func (r *Reader) wait(index int) error {
+	st := r.tr.sess.store
+	for {
+		// take the channel before looking so a piece can't slip in between
+		changed := st.changed()
+		if st.hasPiece(index) {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-r.tr.done:
+			return errTransferClosed
+		}
+	}
+}
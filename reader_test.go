@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testTransfer runs the run loop of a transfer over a test session.
+func testTransfer(t *testing.T, sess *session) *Transfer {
+	tr := &Transfer{
+		sess:     sess,
+		results:  sess.results,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go tr.run()
+	t.Cleanup(tr.Close)
+
+	return tr
+}
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 6*32768+500)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+
+	seedStore, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	leech := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+	tr := testTransfer(t, leech)
+	connectSessions(t, leech, testSession(t, info, seedStore))
+
+	r := tr.NewReader(context.Background())
+
+	// start reading from the end, across the last two pieces
+	off := int64(len(data) - 40000)
+	_, err = r.Seek(off, io.SeekStart)
+	if err != nil {
+		t.Fatalf("could not seek: %s", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not read: %s", err)
+	}
+	if !bytes.Equal(got, data[off:]) {
+		t.Fatalf("read the wrong data")
+	}
+
+	buf := make([]byte, 1000)
+	n, err := r.ReadAt(buf, 32000)
+	if err != nil || n != len(buf) || !bytes.Equal(buf, data[32000:33000]) {
+		t.Fatalf("read the wrong data across pieces, n=%d err=%v", n, err)
+	}
+}
+
+func TestReaderCancel(t *testing.T) {
+	info := testTorrent(make([]byte, 32768), 32768)
+	tr := testTransfer(t, testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil))))
+
+	// there are no peers, so the read can only end with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := tr.NewReader(ctx).Read(make([]byte, 10))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to end the read, got=%v", err)
+	}
+}
+
+func TestReadAheadStaysInFile(t *testing.T) {
+	// the first file ends in the middle of piece 2
+	info := multiFileTorrent(make([]byte, 10*100), 100, 250, 750)
+	sess := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+	tr := &Transfer{sess: sess}
+
+	tr.NewFileReader(context.Background(), 0).readAhead(0)
+
+	sess.picker.urgentMu.Lock()
+	defer sess.picker.urgentMu.Unlock()
+	if len(sess.picker.urgent) != 3 {
+		t.Fatalf("expected only the pieces of the first file to be prioritized, got=%v", sess.picker.urgent)
+	}
+	for index := range sess.picker.urgent {
+		if index > 2 {
+			t.Fatalf("expected piece %d of the next file to be left alone", index)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// fileProgress is how much of a file is covered by pieces we have.
+type fileProgress struct {
+	path   string
+	length int
+	have   int
+}
+
+func (fp fileProgress) complete() bool {
+	return fp.have == fp.length
+}
+
+// recheck hashes whatever the storage holds for the pieces we don't have
+// yet on every core and marks the ones that match, it returns how many did.
+func recheck(st *pieceStore) int {
+	return recheckWith(st, runtime.NumCPU())
+}
+
+func recheckWith(st *pieceStore, workers int) int {
+	indexes := make(chan int)
+	found := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if st.verifyPiece(index) {
+					st.markPiece(index)
+					found <- index
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for index := range st.info.pieces {
+			if !st.hasPiece(index) {
+				indexes <- index
+			}
+		}
+		close(indexes)
+		wg.Wait()
+		close(found)
+	}()
+
+	n := 0
+	for range found {
+		n++
+	}
+
+	return n
+}
+
+// recheckExisting looks for content already on disk when there is no resume
+// file, so data copied in from elsewhere isn't downloaded again. existing is
+// what the files looked like before this run created or allocated them, it
+// reports whether anything was hashed.
+func recheckExisting(t *Torrent, st *pieceStore, existing []fileState) bool {
+	for _, state := range existing {
+		if state.size > 0 {
+			n := recheck(st)
+			fmt.Printf("found %d of %d pieces on disk\n", n, len(t.info.pieces))
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileProgress works out how much of each file the pieces we have cover.
+func (st *pieceStore) fileProgress() []fileProgress {
+	have := st.bitfield()
+	info := st.info
+
+	progress := make([]fileProgress, len(info.files))
+	for i, f := range info.files {
+		progress[i] = fileProgress{path: f.path, length: f.length}
+	}
+
+	for index := range info.pieces {
+		if !have.HasPiece(index) {
+			continue
+		}
+
+		off := int64(index) * int64(info.pieceLength)
+		for _, span := range info.fileSpans(off, info.pieceSize(index)) {
+			progress[span.file].have += span.length
+		}
+	}
+
+	return progress
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecheck(t *testing.T) {
+	data := make([]byte, 4*32768)
+	rand.Read(data)
+	info := multiFileTorrent(data, 32768, 65536, 65536)
+	dir := t.TempDir()
+
+	// the first file is there in full, the second one got cut short
+	os.MkdirAll(filepath.Join(dir, "multi"), 0755)
+	os.WriteFile(filepath.Join(dir, "multi", "a"), data[:65536], 0644)
+	os.WriteFile(filepath.Join(dir, "multi", "b"), data[65536:100000], 0644)
+
+	storage, err := openReadOnlyStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	defer storage.Close()
+
+	st := newPieceStore(info, storage)
+	if n := recheck(st); n != 3 {
+		t.Fatalf("expected 3 good pieces, got=%d", n)
+	}
+	if st.hasPiece(3) {
+		t.Fatalf("expected the cut off piece to be missing")
+	}
+
+	progress := st.fileProgress()
+	if !progress[0].complete() || progress[1].have != 32768 {
+		t.Fatalf("expected the first file complete and half the second, got=%v", progress)
+	}
+}
+
+func TestRecheckMissingFiles(t *testing.T) {
+	info := multiFileTorrent(make([]byte, 100), 30, 50, 50)
+
+	storage, err := openReadOnlyStorage(info, t.TempDir())
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	defer storage.Close()
+
+	if n := recheck(newPieceStore(info, storage)); n != 0 {
+		t.Fatalf("expected nothing to match, got=%d", n)
+	}
+}
+
+func TestRecheckExistingSkipsNewFiles(t *testing.T) {
+	data := make([]byte, 4*32768)
+	rand.Read(data)
+	info := multiFileTorrent(data, 32768, 65536, 65536)
+	dir := t.TempDir()
+	torrent := &Torrent{info: info}
+
+	// the files only get their size from the allocation
+	existing, err := statFiles(info, dir)
+	if err != nil {
+		t.Fatalf("could not stat the files: %s", err)
+	}
+	err = prepareFiles(info, dir, allocateFull)
+	if err != nil {
+		t.Fatalf("could not allocate the files: %s", err)
+	}
+
+	storage, err := openFileStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	defer storage.Close()
+	st := newPieceStore(info, storage)
+
+	if recheckExisting(torrent, st, existing) {
+		t.Fatalf("expected files this run allocated not to be hashed")
+	}
+
+	// on the next start they count as existing
+	existing, _ = statFiles(info, dir)
+	if !recheckExisting(torrent, st, existing) {
+		t.Fatalf("expected files that were there before to be hashed")
+	}
+}
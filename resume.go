@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+// RESUMEINTERVAL is how often the progress of a download is saved
+const RESUMEINTERVAL = 30 * time.Second
+
+// transferStats counts the bytes of blocks moved over every connection of a
+// session, they carry over restarts in the resume file.
+type transferStats struct {
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+}
+
+// resumeData is what we need to pick a download back up where it stopped.
+type resumeData struct {
+	infoHash   [20]byte
+	bitfield   Bitfield
+	partial    map[int][]int // piece index to the begin of the blocks on disk
+	files      []fileState
+	peers      Peers
+	downloaded int
+	uploaded   int
+
+	blocks map[int]map[int][]byte // the partial blocks that survived restore
+}
+
+// fileState is what a file looked like when the resume file was written, a
+// file that changed since can't be trusted.
+type fileState struct {
+	size  int64
+	mtime int64 // in unix nanoseconds
+}
+
+// resumePath is where the resume file of the torrent goes, next to its
+// files.
+func resumePath(info *TorrentFile, dir string) string {
+	return filepath.Join(dir, "."+hex.EncodeToString(info.infoHash[:])+".resume")
+}
+
+// statFiles records the size and modification time of every file of the
+// torrent, files that aren't there yet get a zero state.
+func statFiles(info *TorrentFile, dir string) ([]fileState, error) {
+	states := make([]fileState, len(info.files))
+	for i, f := range info.files {
+		stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.path)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		states[i] = fileState{stat.Size(), stat.ModTime().UnixNano()}
+	}
+
+	return states, nil
+}
+
+// saveResume writes the progress of the session next to its files. The
+// blocks of unfinished pieces are written to the storage first so only
+// their offsets have to go in the resume file.
+func (sess *session) saveResume() error {
+	t := sess.t
+	rd := &resumeData{
+		infoHash:   t.info.infoHash,
+		partial:    make(map[int][]int),
+		peers:      sess.swarm.knownPeers(),
+		downloaded: int(sess.stats.downloaded.Load()),
+		uploaded:   int(sess.stats.uploaded.Load()),
+	}
+
+	for index, blocks := range sess.active.partials() {
+		for begin, block := range blocks {
+			err := sess.store.writeBlock(index, begin, block)
+			if err != nil {
+				return err
+			}
+			rd.partial[index] = append(rd.partial[index], begin)
+		}
+	}
+
+	// the files are stated while nothing else can write to them, so the
+	// bitfield matches what is on disk
+	err := sess.store.snapshot(func(have Bitfield, storage Storage) error {
+		rd.bitfield = have
+
+		err := storage.Sync()
+		if err != nil {
+			return err
+		}
+
+		rd.files, err = statFiles(t.info, t.config.dir)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := rd.encode()
+	if err != nil {
+		return err
+	}
+
+	// a crash halfway through the write must not cost us the old file
+	path := resumePath(t.info, t.config.dir)
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (rd *resumeData) encode() ([]byte, error) {
+	partial := bencode.List{}
+	indexes := make([]int, 0, len(rd.partial))
+	for index := range rd.partial {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		blocks := bencode.List{}
+		for _, begin := range rd.partial[index] {
+			blocks = append(blocks, begin)
+		}
+		partial = append(partial, bencode.Dictionary{"piece": index, "blocks": blocks})
+	}
+
+	files := bencode.List{}
+	for _, f := range rd.files {
+		files = append(files, bencode.Dictionary{"size": int(f.size), "mtime": int(f.mtime)})
+	}
+
+	peers, peers6 := serializePeers(rd.peers)
+
+	return bencode.Encode(bencode.Dictionary{
+		"info hash":  rd.infoHash[:],
+		"bitfield":   []byte(rd.bitfield),
+		"partial":    partial,
+		"files":      files,
+		"peers":      peers,
+		"peers6":     peers6,
+		"downloaded": rd.downloaded,
+		"uploaded":   rd.uploaded,
+	})
+}
+
+// loadResume reads the resume file of the torrent, it fails if there is
+// none or it belongs to another torrent.
+func loadResume(info *TorrentFile, dir string) (*resumeData, error) {
+	f, err := os.Open(resumePath(info, dir))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	val, err := bencode.NewDecoder(f).Decode()
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := val.(bencode.Dictionary)
+	if !ok {
+		return nil, errors.New("expected the resume file to be a dictionary")
+	}
+
+	rd := &resumeData{partial: make(map[int][]int)}
+
+	infoHash, _ := dict["info hash"].([]byte)
+	if len(infoHash) != 20 || [20]byte(infoHash) != info.infoHash {
+		return nil, errors.New("the resume file is for another torrent")
+	}
+	rd.infoHash = info.infoHash
+
+	bitfield, _ := dict["bitfield"].([]byte)
+	if len(bitfield) != len(newBitfield(len(info.pieces))) {
+		return nil, errors.New("the bitfield does not match the torrent")
+	}
+	rd.bitfield = Bitfield(bitfield)
+
+	files, _ := dict["files"].(bencode.List)
+	if len(files) != len(info.files) {
+		return nil, errors.New("the files do not match the torrent")
+	}
+	for _, val := range files {
+		file, _ := val.(bencode.Dictionary)
+		size, _ := file["size"].(int)
+		mtime, _ := file["mtime"].(int)
+		rd.files = append(rd.files, fileState{int64(size), int64(mtime)})
+	}
+
+	partial, _ := dict["partial"].(bencode.List)
+	for _, val := range partial {
+		p, _ := val.(bencode.Dictionary)
+		index, ok := p["piece"].(int)
+		if !ok || index < 0 || index >= len(info.pieces) {
+			continue
+		}
+
+		blocks, _ := p["blocks"].(bencode.List)
+		for _, val := range blocks {
+			begin, ok := val.(int)
+			if ok && begin >= 0 && begin%MAXBLOCKSIZE == 0 && begin < info.pieceSize(index) {
+				rd.partial[index] = append(rd.partial[index], begin)
+			}
+		}
+	}
+
+	// peers are a bonus, broken ones are just skipped
+	if data, ok := dict["peers"].([]byte); ok {
+		peers, err := deserializePeers(data)
+		if err == nil {
+			rd.peers = append(rd.peers, peers...)
+		}
+	}
+	if data, ok := dict["peers6"].([]byte); ok {
+		peers, err := deserializePeers6(data)
+		if err == nil {
+			rd.peers = append(rd.peers, peers...)
+		}
+	}
+
+	rd.downloaded, _ = dict["downloaded"].(int)
+	rd.uploaded, _ = dict["uploaded"].(int)
+
+	return rd, nil
+}
+
+// resume picks up the progress in the resume file of the torrent, if there
+// is one, by marking the pieces we have in the store and adding the peers
+// we knew to the torrent. The rest of it goes to the session with
+// resumeSession once there is one.
+func resume(t *Torrent, st *pieceStore) *resumeData {
+	rd, err := loadResume(t.info, t.config.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		fmt.Println("could not load the resume file, starting over:", err)
+		return nil
+	}
+
+	rd.blocks, err = rd.restore(st, t.config.dir)
+	if err != nil {
+		fmt.Println("could not restore the resume file, starting over:", err)
+		return nil
+	}
+	t.peers = append(t.peers, rd.peers...)
+
+	fmt.Printf("resuming with %d of %d pieces\n", st.count(), len(t.info.pieces))
+
+	return rd
+}
+
+// resumeSession hands the unfinished pieces and counters of the resume data
+// to the session.
+func (sess *session) resumeSession(rd *resumeData) {
+	for index, blocks := range rd.blocks {
+		p := &piece{index, sess.t.info.pieces[index], sess.t.info.pieceSize(index)}
+		sess.active.restore(p, blocks)
+	}
+
+	sess.stats.downloaded.Store(int64(rd.downloaded))
+	sess.stats.uploaded.Store(int64(rd.uploaded))
+}
+
+// changedFiles compares the files on disk to the resume data, the pieces
+// that touch a changed file have to be checked again. Every write we do
+// after saving changes the mtime too, so after a crash this is normal.
+func (rd *resumeData) changedFiles(info *TorrentFile, dir string) ([]bool, error) {
+	states, err := statFiles(info, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]bool, len(info.files))
+	for i := range info.files {
+		changed[i] = states[i] != rd.files[i]
+	}
+
+	return changed, nil
+}
+
+// restore marks the pieces of the resume data in the store, pieces whose
+// files are unchanged are trusted and the others are hashed again. It
+// returns the blocks of unfinished pieces that are still good.
+func (rd *resumeData) restore(st *pieceStore, dir string) (map[int]map[int][]byte, error) {
+	info := st.info
+	changed, err := rd.changedFiles(info, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	touchesChanged := func(index int) bool {
+		off := int64(index) * int64(info.pieceLength)
+		for _, span := range info.fileSpans(off, info.pieceSize(index)) {
+			if changed[span.file] {
+				return true
+			}
+		}
+		return false
+	}
+
+	rechecked, bad := 0, 0
+	for index := range info.pieces {
+		if !rd.bitfield.HasPiece(index) {
+			continue
+		}
+
+		if !touchesChanged(index) {
+			st.markPiece(index)
+			continue
+		}
+
+		rechecked++
+		if st.verifyPiece(index) {
+			st.markPiece(index)
+		} else {
+			bad++
+		}
+	}
+	if rechecked > 0 {
+		fmt.Printf("rechecked %d pieces of changed files, %d of them are gone\n", rechecked, bad)
+	}
+
+	// there is no hash for a block, so blocks in changed files are dropped
+	partial := make(map[int]map[int][]byte)
+	for index, begins := range rd.partial {
+		if st.hasPiece(index) || touchesChanged(index) {
+			continue
+		}
+
+		blocks := make(map[int][]byte)
+		for _, begin := range begins {
+			block := make([]byte, blockSize(info.pieceSize(index), begin))
+			err := st.readRaw(block, index, begin)
+			if err != nil {
+				continue
+			}
+			blocks[begin] = block
+		}
+		partial[index] = blocks
+	}
+
+	return partial, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResume(t *testing.T) {
+	data := make([]byte, 4*32768)
+	rand.Read(data)
+	info := multiFileTorrent(data, 32768, 40000, 40000, 51072)
+	dir := t.TempDir()
+
+	storage, err := openFileStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	st := newPieceStore(info, storage)
+	sess := testSession(t, info, st)
+	sess.t.config.dir = dir
+	sess.stats.downloaded.Store(1234)
+
+	for _, index := range []int{0, 2} {
+		st.writePiece(index, data[index*32768:(index+1)*32768])
+	}
+	p := &piece{3, info.pieces[3], 32768}
+	ap := sess.active.start(p, &client{})
+	sess.active.receive(ap, nil, MAXBLOCKSIZE, data[3*32768+MAXBLOCKSIZE:4*32768])
+
+	err = sess.saveResume()
+	if err != nil {
+		t.Fatalf("could not save the resume file: %s", err)
+	}
+	st.close()
+
+	storage, err = openFileStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not reopen the storage: %s", err)
+	}
+	defer storage.Close()
+	st = newPieceStore(info, storage)
+	rd := resume(sess.t, st)
+	if rd == nil {
+		t.Fatalf("expected the resume file to load")
+	}
+
+	if !st.hasPiece(0) || st.hasPiece(1) || !st.hasPiece(2) || st.hasPiece(3) {
+		t.Fatalf("expected pieces 0 and 2 to be back, got=%08b", st.bitfield())
+	}
+	if rd.downloaded != 1234 {
+		t.Fatalf("expected the counters to be back, got=%d", rd.downloaded)
+	}
+	block, ok := rd.blocks[3][MAXBLOCKSIZE]
+	if !ok || !bytes.Equal(block, data[3*32768+MAXBLOCKSIZE:4*32768]) {
+		t.Fatalf("expected the partial block of piece 3 to be back")
+	}
+}
+
+func TestResumeChangedFile(t *testing.T) {
+	data := make([]byte, 2*32768)
+	rand.Read(data)
+	info := multiFileTorrent(data, 32768, 32768, 32768)
+	dir := t.TempDir()
+
+	storage, err := openFileStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	st := newPieceStore(info, storage)
+	sess := testSession(t, info, st)
+	sess.t.config.dir = dir
+
+	st.writePiece(0, data[:32768])
+	st.writePiece(1, data[32768:])
+	err = sess.saveResume()
+	if err != nil {
+		t.Fatalf("could not save the resume file: %s", err)
+	}
+	st.close()
+
+	// someone scribbles over the second file behind our back
+	name := filepath.Join(dir, "multi", "b")
+	os.WriteFile(name, make([]byte, 32768), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(name, later, later)
+
+	storage, err = openFileStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not reopen the storage: %s", err)
+	}
+	defer storage.Close()
+	st = newPieceStore(info, storage)
+	if resume(sess.t, st) == nil {
+		t.Fatalf("expected the resume file to load")
+	}
+
+	if !st.hasPiece(0) || st.hasPiece(1) {
+		t.Fatalf("expected only the untouched piece to be kept, got=%08b", st.bitfield())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Seed serves a finished download of the torrent from its storage to other
+// peers until done is closed.
+func Seed(t *Torrent, done <-chan struct{}) error {
+	storage, err := openStorage(t)
+	if err != nil {
+		return err
+	}
+
+	st, err := loadPieceStore(t.info, storage)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	defer st.close()
+	t.seeding = true
+
+	fmt.Println("seeding", t.info.name)
+
+	// there is nothing to download, the workers go straight to serving
+	sess, err := startSession(t, st, nil, done)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case peer := <-sess.swarm.newPeers:
+			go sess.startWorker(peer)
+		case <-done:
+			if cs, ok := storage.(*cachedStorage); ok {
+				fmt.Println("cache:", cs.currentStats())
+			}
+			return nil
+		}
+	}
+}
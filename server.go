@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Handler serves the files of the torrent over http while they download, each
+// file at its path in the torrent. Range requests only wait for the pieces
+// they cover, so players can seek ahead.
+func (tr *Transfer) Handler() http.Handler {
+	return http.HandlerFunc(tr.serveHTTP)
+}
+
+func (tr *Transfer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files := tr.sess.t.info.files
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		tr.serveIndex(w)
+		return
+	}
+
+	for index, f := range files {
+		if f.path != name {
+			continue
+		}
+
+		// without a type ServeContent sniffs it, which means waiting for
+		// the first piece
+		contentType := mime.TypeByExtension(path.Ext(f.path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+
+		// the reader gives up when the client goes away
+		r := tr.NewFileReader(req.Context(), index)
+		http.ServeContent(w, req, f.path, time.Time{}, r)
+		return
+	}
+
+	http.NotFound(w, req)
+}
+
+// serveIndex lists the files of the torrent with links to them.
+func (tr *Transfer) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	fmt.Fprintf(w, "<h1>%s</h1>\n<ul>\n", html.EscapeString(tr.sess.t.info.name))
+	for _, f := range tr.sess.t.info.files {
+		link := (&url.URL{Path: "/" + f.path}).String()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", html.EscapeString(link), html.EscapeString(f.path), f.length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeRange(t *testing.T) {
+	data := make([]byte, 4*32768)
+	rand.Read(data)
+	info := testTorrent(data, 32768)
+
+	seedStore, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	leech := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+	tr := testTransfer(t, leech)
+	connectSessions(t, leech, testSession(t, info, seedStore))
+
+	srv := httptest.NewServer(tr.Handler())
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/test.txt", nil)
+	if err != nil {
+		t.Fatalf("could not build the request: %s", err)
+	}
+	req.Header.Set("Range", "bytes=70000-70099")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not get the file: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read the body: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected a partial response, got=%d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != "100" {
+		t.Fatalf("expected a length of 100, got=%s", resp.Header.Get("Content-Length"))
+	}
+	if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("expected a text type, got=%s", resp.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(body, data[70000:70100]) {
+		t.Fatalf("got the wrong bytes")
+	}
+
+	resp, err = http.Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatalf("could not get: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found, got=%d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where the content of a torrent ends up. Pieces are addressed by
+// their index and an offset into the piece, it is up to the storage to map
+// them onto files. A range can run on into the pieces after it, so pieces
+// next to each other can go out in one write.
+type Storage interface {
+	ReadAt(p []byte, index, begin int) (int, error)
+	WriteAt(p []byte, index, begin int) (int, error)
+	Sync() error // flushes what was written to the disk
+	Close() error
+}
+
+// StorageOpener opens the storage for a torrent under dir.
+type StorageOpener func(info *TorrentFile, dir string) (Storage, error)
+
+// openStorage opens the storage of the torrent the way its config says, with
+// the caches in front of it.
+func openStorage(t *Torrent) (Storage, error) {
+	storage, err := t.config.storage(t.info, t.config.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the storage: %s", err)
+	}
+
+	if t.config.writeCache == 0 && t.config.readCache == 0 {
+		return storage, nil
+	}
+
+	return newCachedStorage(t.info, storage, t.config.writeCache, t.config.readCache), nil
+}
+
+func parseStorage(s string) (StorageOpener, error) {
+	switch s {
+	case "file":
+		return openFileStorage, nil
+	case "mmap":
+		return openMmapStorage, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage %q, expected file or mmap", s)
+}
+
+// fileSpan is the part of a file a range of the content falls on.
+type fileSpan struct {
+	file   int   // index into the files of the torrent
+	offset int64 // into the file
+	start  int   // into the range
+	length int
+}
+
+// fileSpans cuts the length bytes of content starting at off into the files
+// they belong to.
+func (t *TorrentFile) fileSpans(off int64, length int) []fileSpan {
+	var spans []fileSpan
+	end := off + int64(length)
+
+	for i, f := range t.files {
+		fileStart, fileEnd := int64(f.offset), int64(f.offset+f.length)
+		if fileEnd <= off || f.length == 0 {
+			continue
+		}
+		if fileStart >= end {
+			break
+		}
+
+		from, to := max(off, fileStart), min(end, fileEnd)
+		spans = append(spans, fileSpan{
+			file:   i,
+			offset: from - fileStart,
+			start:  int(from - off),
+			length: int(to - from),
+		})
+	}
+
+	return spans
+}
+
+// pieceOffset is where the block at begin in the piece at index sits in the
+// content of the torrent, it checks the block starts in the piece and ends
+// before the content does.
+func (t *TorrentFile) pieceOffset(index, begin, length int) (int64, error) {
+	if index < 0 || index >= len(t.pieces) {
+		return 0, fmt.Errorf("piece %d out of range", index)
+	}
+	if begin < 0 || begin >= t.pieceSize(index) || length < 0 {
+		return 0, errors.New("the block is outside of the piece")
+	}
+
+	off := int64(index)*int64(t.pieceLength) + int64(begin)
+	if off+int64(length) > int64(t.length) {
+		return 0, errors.New("the block runs past the end of the torrent")
+	}
+
+	return off, nil
+}
+
+// fileStorage keeps the content in the files of the torrent under a
+// directory, the same layout every other client uses.
+type fileStorage struct {
+	info  *TorrentFile
+	files []*os.File
+}
+
+// openFileStorage opens or creates every file of the torrent under dir,
+// whatever is already in them is left alone so a download can pick up where
+// it left off.
+func openFileStorage(info *TorrentFile, dir string) (Storage, error) {
+	files, err := openFiles(info, dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStorage{info: info, files: files}, nil
+}
+
+// openReadOnlyStorage opens the files of the torrent under dir without
+// creating or changing them, missing files read as missing data.
+func openReadOnlyStorage(info *TorrentFile, dir string) (Storage, error) {
+	files, err := openFiles(info, dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStorage{info: info, files: files}, nil
+}
+
+// openFiles opens or creates every file of the torrent under dir. Read only
+// it creates nothing and leaves a nil file for the missing ones.
+func openFiles(info *TorrentFile, dir string, readOnly bool) ([]*os.File, error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}
+
+	for _, f := range info.files {
+		name := filepath.Join(dir, filepath.FromSlash(f.path))
+		if readOnly {
+			file, err := os.Open(name)
+			if err != nil && !os.IsNotExist(err) {
+				closeAll()
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func (fs *fileStorage) ReadAt(p []byte, index, begin int) (int, error) {
+	off, err := fs.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, span := range fs.info.fileSpans(off, len(p)) {
+		if fs.files[span.file] == nil {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		read, err := fs.files[span.file].ReadAt(p[span.start:span.start+span.length], span.offset)
+		n += read
+		if err == io.EOF {
+			// the piece was never written, a sparse file can end early
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (fs *fileStorage) WriteAt(p []byte, index, begin int) (int, error) {
+	off, err := fs.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, span := range fs.info.fileSpans(off, len(p)) {
+		if fs.files[span.file] == nil {
+			return n, errors.New("the storage is read only")
+		}
+
+		written, err := fs.files[span.file].WriteAt(p[span.start:span.start+span.length], span.offset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (fs *fileStorage) Sync() error {
+	for _, f := range fs.files {
+		if f == nil {
+			continue
+		}
+
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *fileStorage) Close() error {
+	var first error
+	for _, f := range fs.files {
+		if f == nil {
+			continue
+		}
+
+		err := f.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
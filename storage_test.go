@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memoryStorage keeps the content in a slice, so tests don't touch the disk.
+type memoryStorage struct {
+	info *TorrentFile
+	data []byte
+}
+
+// newMemoryStorage starts out with data, or with nothing if data is nil.
+func newMemoryStorage(info *TorrentFile, data []byte) *memoryStorage {
+	if data == nil {
+		data = make([]byte, info.length)
+	}
+
+	return &memoryStorage{info: info, data: data}
+}
+
+func (ms *memoryStorage) ReadAt(p []byte, index, begin int) (int, error) {
+	off, err := ms.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(p, ms.data[off:]), nil
+}
+
+func (ms *memoryStorage) WriteAt(p []byte, index, begin int) (int, error) {
+	off, err := ms.info.pieceOffset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(ms.data[off:], p), nil
+}
+
+func (ms *memoryStorage) Sync() error {
+	return nil
+}
+
+func (ms *memoryStorage) Close() error {
+	return nil
+}
+
+// storeBytes reads the whole content back out of the store.
+func storeBytes(t *testing.T, st *pieceStore) []byte {
+	data := make([]byte, st.info.length)
+	_, err := st.readAt(data, 0)
+	if err != nil {
+		t.Fatalf("could not read the store: %s", err)
+	}
+
+	return data
+}
+
+// multiFileTorrent spreads data over files of the given lengths.
+func multiFileTorrent(data []byte, pieceLength int, lengths ...int) *TorrentFile {
+	info := testTorrent(data, pieceLength)
+	info.name = "multi"
+	info.files = nil
+
+	offset := 0
+	for i, length := range lengths {
+		info.files = append(info.files, fileEntry{
+			path:   info.name + "/" + string(rune('a'+i)),
+			length: length,
+			offset: offset,
+		})
+		offset += length
+	}
+
+	return info
+}
+
+func TestFileSpans(t *testing.T) {
+	info := multiFileTorrent(make([]byte, 100), 30, 10, 0, 50, 40)
+
+	spans := info.fileSpans(5, 60)
+	expected := []fileSpan{
+		{file: 0, offset: 5, start: 0, length: 5},
+		{file: 2, offset: 0, start: 5, length: 50},
+		{file: 3, offset: 0, start: 55, length: 5},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got=%v", len(expected), spans)
+	}
+	for i := range expected {
+		if spans[i] != expected[i] {
+			t.Fatalf("span %d: expected=%v, got=%v", i, expected[i], spans[i])
+		}
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	testStorage(t, openFileStorage)
+}
+
+func TestMmapStorage(t *testing.T) {
+	testStorage(t, openMmapStorage)
+}
+
+func TestMmapStorageClosed(t *testing.T) {
+	data := make([]byte, 100)
+	info := multiFileTorrent(data, 30, 60, 40)
+	dir := t.TempDir()
+
+	storage, err := openMmapStorage(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+
+	// the mapped files are allocated up front, a sparse one could fault
+	for _, f := range info.files {
+		stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.path)))
+		if err != nil || stat.Size() != int64(f.length) {
+			t.Fatalf("expected %s to be allocated, got=%v %s", f.path, stat, err)
+		}
+	}
+
+	storage.Close()
+
+	_, err = storage.ReadAt(make([]byte, 10), 0, 0)
+	if err == nil {
+		t.Fatalf("expected reading a closed storage to fail")
+	}
+	_, err = storage.WriteAt(make([]byte, 10), 0, 0)
+	if err == nil {
+		t.Fatalf("expected writing a closed storage to fail")
+	}
+}
+
+func TestCachedFileStorage(t *testing.T) {
+	testStorage(t, func(info *TorrentFile, dir string) (Storage, error) {
+		storage, err := openFileStorage(info, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return newCachedStorage(info, storage, 1<<20, 1<<20), nil
+	})
+}
+
+// testStorage writes a multi file torrent through the storage and checks
+// the files on disk.
+func testStorage(t *testing.T, open StorageOpener) {
+	data := make([]byte, 100)
+	rand.Read(data)
+	info := multiFileTorrent(data, 30, 10, 0, 50, 40)
+	dir := t.TempDir()
+
+	storage, err := open(info, dir)
+	if err != nil {
+		t.Fatalf("could not open the storage: %s", err)
+	}
+	st := newPieceStore(info, storage)
+
+	// the pieces come in out of order and straddle the files
+	for _, index := range []int{3, 1, 0, 2} {
+		begin := index * info.pieceLength
+		_, err := st.writePiece(index, data[begin:begin+info.pieceSize(index)])
+		if err != nil {
+			t.Fatalf("could not write piece %d: %s", index, err)
+		}
+	}
+	if !bytes.Equal(storeBytes(t, st), data) {
+		t.Fatalf("expected to read back what was written")
+	}
+	st.close()
+
+	for _, f := range info.files {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.path)))
+		if err != nil {
+			t.Fatalf("could not read %s: %s", f.path, err)
+		}
+		if !bytes.Equal(content, data[f.offset:f.offset+f.length]) {
+			t.Fatalf("%s does not hold its part of the content", f.path)
+		}
+	}
+
+	// opening it again finds the finished download
+	storage, err = open(info, dir)
+	if err != nil {
+		t.Fatalf("could not reopen the storage: %s", err)
+	}
+	defer storage.Close()
+	st, err = loadPieceStore(info, storage)
+	if err != nil {
+		t.Fatalf("could not load the finished download: %s", err)
+	}
+	if !st.complete() {
+		t.Fatalf("expected the store to be complete")
+	}
+}
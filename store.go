@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// pieceStore keeps track of the pieces we have of a torrent, workers write
+// the pieces they verified through it and uploads read the blocks peers ask
+// for from it. The content itself is in the storage.
+type pieceStore struct {
+	mu      sync.RWMutex
+	info    *TorrentFile
+	storage Storage
+	have    Bitfield
+	numHave int
+	updated chan struct{} // closed and replaced every time a piece comes in
+}
+
+func newPieceStore(info *TorrentFile, storage Storage) *pieceStore {
+	return &pieceStore{
+		info:    info,
+		storage: storage,
+		have:    newBitfield(len(info.pieces)),
+		updated: make(chan struct{}),
+	}
+}
+
+// loadPieceStore wraps a finished download, every piece has to match its
+// hash so we never hand out broken data.
+func loadPieceStore(info *TorrentFile, storage Storage) (*pieceStore, error) {
+	st := newPieceStore(info, storage)
+
+	recheck(st)
+	if !st.complete() {
+		return nil, fmt.Errorf("piece %d does not match the torrent", st.firstMissing())
+	}
+
+	return st, nil
+}
+
+// writePiece stores a verified piece, it reports false if we already had it.
+func (st *pieceStore) writePiece(index int, data []byte) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.have.HasPiece(index) {
+		return false, nil
+	}
+
+	_, err := st.storage.WriteAt(data, index, 0)
+	if err != nil {
+		return false, err
+	}
+	st.have.SetPiece(index)
+	st.numHave++
+
+	// the last piece makes the download worth keeping, so it goes to the disk
+	// before anyone hears we're done
+	if st.numHave == len(st.info.pieces) {
+		err = st.storage.Sync()
+		if err != nil {
+			fmt.Println("could not sync the storage", err)
+		}
+	}
+
+	close(st.updated)
+	st.updated = make(chan struct{})
+
+	return true, nil
+}
+
+// writeBlock puts a block of a piece we don't have yet in the storage, so it
+// survives a restart. The piece is not verified so nobody can read it.
+func (st *pieceStore) writeBlock(index, begin int, block []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.have.HasPiece(index) {
+		return nil
+	}
+
+	_, err := st.storage.WriteAt(block, index, begin)
+	return err
+}
+
+// readRaw reads from the storage whether we have the piece or not.
+func (st *pieceStore) readRaw(p []byte, index, begin int) error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	_, err := st.storage.ReadAt(p, index, begin)
+	return err
+}
+
+// verifyPiece hashes what the storage holds for the piece.
+func (st *pieceStore) verifyPiece(index int) bool {
+	p := &piece{index, st.info.pieces[index], st.info.pieceSize(index)}
+	buf := make([]byte, p.length)
+
+	err := st.readRaw(buf, index, 0)
+	if err != nil {
+		return false
+	}
+
+	return checkIntegrity(p, buf)
+}
+
+// markPiece records that the storage already holds the piece.
+func (st *pieceStore) markPiece(index int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.have.HasPiece(index) {
+		return
+	}
+	st.have.SetPiece(index)
+	st.numHave++
+
+	close(st.updated)
+	st.updated = make(chan struct{})
+}
+
+// snapshot runs fn with a copy of the pieces we have while nothing can be
+// written, so what fn sees in the storage matches.
+func (st *pieceStore) snapshot(fn func(have Bitfield, storage Storage) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	have := make(Bitfield, len(st.have))
+	copy(have, st.have)
+
+	return fn(have, st.storage)
+}
+
+// changed returns a channel that is closed when the next piece comes in.
+func (st *pieceStore) changed() <-chan struct{} {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.updated
+}
+
+// readAt copies the content at off into p, the pieces it covers have to be
+// in.
+func (st *pieceStore) readAt(p []byte, off int64) (int, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	n := 0
+	for n < len(p) && off < int64(st.info.length) {
+		index := int(off / int64(st.info.pieceLength))
+		begin := int(off % int64(st.info.pieceLength))
+		length := min(len(p)-n, st.info.pieceSize(index)-begin)
+
+		if !st.have.HasPiece(index) {
+			return n, errors.New("we don't have the piece")
+		}
+		read, err := st.storage.ReadAt(p[n:n+length], index, begin)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		off += int64(read)
+	}
+
+	return n, nil
+}
+
+func (st *pieceStore) readBlock(index, begin, length int) ([]byte, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if !st.have.HasPiece(index) {
+		return nil, errors.New("we don't have the piece")
+	}
+	if begin < 0 || length < 0 || begin+length > st.info.pieceSize(index) {
+		return nil, errors.New("the block is outside of the piece")
+	}
+
+	block := make([]byte, length)
+	_, err := st.storage.ReadAt(block, index, begin)
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (st *pieceStore) hasPiece(index int) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.have.HasPiece(index)
+}
+
+// bitfield returns a copy of the pieces we have.
+func (st *pieceStore) bitfield() Bitfield {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	bf := make(Bitfield, len(st.have))
+	copy(bf, st.have)
+
+	return bf
+}
+
+// count is the number of pieces we have.
+func (st *pieceStore) count() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.numHave
+}
+
+// firstMissing is the index of the first piece we don't have.
+func (st *pieceStore) firstMissing() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	for index := range st.info.pieces {
+		if !st.have.HasPiece(index) {
+			return index
+		}
+	}
+
+	return len(st.info.pieces)
+}
+
+func (st *pieceStore) complete() bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.numHave == len(st.info.pieces)
+}
+
+// close closes the storage, nothing can be read or written after.
+func (st *pieceStore) close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.storage.Close()
+}
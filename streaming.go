@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	STREAMWINDOW    = 8               // pieces ahead of the read cursor that come first
+	STREAMPIECETIME = 2 * time.Second // time each piece in the window gets before it is late
+)
+
+// deadliner is implemented by pickers that want some pieces by a certain
+// time, pieces that are late get requested from more peers.
+type deadliner interface {
+	Deadline(index int) (time.Time, bool)
+}
+
+// Streaming downloads the pieces just ahead of a read cursor first, in order
+// and with deadlines, so the data can be used before the download finishes.
+// Everything outside of the window is left to the fallback picker.
+type Streaming struct {
+	mu        sync.Mutex
+	cursor    int
+	window    int
+	fallback  PiecePicker
+	deadlines map[int]time.Time
+}
+
+// NewStreaming returns a streaming picker with its cursor at the first piece
+// and rarest first for the rest.
+func NewStreaming(window int) *Streaming {
+	s := &Streaming{
+		window:    window,
+		fallback:  RarestFirst{},
+		deadlines: make(map[int]time.Time),
+	}
+	s.setDeadlines(time.Now())
+
+	return s
+}
+
+// SetCursor moves the window to start at the piece at index, the pieces new
+// to the window get their deadlines from now.
+func (s *Streaming) SetCursor(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index == s.cursor {
+		return
+	}
+	s.cursor = index
+
+	for i := range s.deadlines {
+		if !s.inWindow(i) {
+			delete(s.deadlines, i)
+		}
+	}
+	s.setDeadlines(time.Now())
+}
+
+func (s *Streaming) setDeadlines(now time.Time) {
+	for i := 0; i < s.window; i++ {
+		if _, ok := s.deadlines[s.cursor+i]; !ok {
+			s.deadlines[s.cursor+i] = now.Add(time.Duration(i+1) * STREAMPIECETIME)
+		}
+	}
+}
+
+func (s *Streaming) inWindow(index int) bool {
+	return index >= s.cursor && index < s.cursor+s.window
+}
+
+func (s *Streaming) Pick(have int, candidates []PieceCandidate) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the candidates are sorted, so the first one in the window is the one
+	// the reader needs soonest
+	for _, cand := range candidates {
+		if s.inWindow(cand.Index) {
+			return cand.Index, true
+		}
+	}
+
+	return s.fallback.Pick(have, candidates)
+}
+
+// Deadline is when the piece should be in, only pieces in the window have
+// one.
+func (s *Streaming) Deadline(index int) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline, ok := s.deadlines[index]
+	return deadline, ok
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamingPick(t *testing.T) {
+	s := NewStreaming(2)
+	candidates := []PieceCandidate{
+		{Index: 1, Availability: 5},
+		{Index: 3, Availability: 5},
+		{Index: 7, Availability: 1},
+	}
+
+	if index, ok := s.Pick(RANDOMPIECES, candidates); !ok || index != 1 {
+		t.Fatalf("expected the piece in the window, got=%d", index)
+	}
+
+	// past the window rarest first takes over
+	s.SetCursor(4)
+	if index, ok := s.Pick(RANDOMPIECES, candidates); !ok || index != 7 {
+		t.Fatalf("expected the rarest piece, got=%d", index)
+	}
+
+	if _, ok := s.Deadline(1); ok {
+		t.Fatalf("expected pieces behind the cursor to lose their deadline")
+	}
+	first, ok := s.Deadline(4)
+	if !ok {
+		t.Fatalf("expected a deadline for the piece at the cursor")
+	}
+	second, _ := s.Deadline(5)
+	if !second.After(first) {
+		t.Fatalf("expected later pieces to get later deadlines")
+	}
+}
+
+func TestLatePiece(t *testing.T) {
+	s := NewStreaming(1)
+	a := newActivePieces()
+	slow, fast := &client{}, &client{bitfield: fullBitfield(2)}
+
+	ap := a.start(&piece{index: 0, length: MAXBLOCKSIZE}, slow)
+	a.nextBlock(ap, slow, false)
+
+	if a.latePiece(fast, s) != nil {
+		t.Fatalf("expected the piece not to be late yet")
+	}
+
+	s.deadlines[0] = time.Now().Add(-time.Second)
+	if a.latePiece(fast, s) != ap {
+		t.Fatalf("expected the late piece to get another peer")
+	}
+	if begin, ok := a.nextBlock(ap, fast, true); !ok || begin != 0 {
+		t.Fatalf("expected the late block to be asked for again, got=%d %v", begin, ok)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MAXPEERS      = 30          // peers we keep open connections to at once
+	MAXKNOWNPEERS = 500         // addresses we remember from trackers and other peers
+	REDIALDELAY   = time.Minute // how long a peer that went away waits before we dial it again
+)
+
+type swarmPeer struct {
+	peer  Peer
+	flags byte
+}
+
+// swarm keeps track of every peer we have heard of during a download so new
+// addresses can be fed to the running download as they are discovered.
+type swarm struct {
+	mu        sync.Mutex
+	known     map[string]Peer
+	connected map[string]swarmPeer
+	newPeers  chan Peer
+	slots     chan struct{}
+}
+
+func newSwarm() *swarm {
+	return &swarm{
+		known:     make(map[string]Peer),
+		connected: make(map[string]swarmPeer),
+		newPeers:  make(chan Peer, MAXKNOWNPEERS),
+		slots:     make(chan struct{}, MAXPEERS),
+	}
+}
+
+// addPeer queues the peer for a connection unless we already know about it.
+func (s *swarm) addPeer(peer Peer) bool {
+	if peer.Port == 0 || peer.IP == nil || peer.IP.IsUnspecified() {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr := peer.String()
+	if _, ok := s.known[addr]; ok {
+		return false
+	}
+	if len(s.known) >= MAXKNOWNPEERS {
+		return false
+	}
+
+	// forgotten peers can still be waiting in the channel, when it is full
+	// the address has to come up again later
+	select {
+	case s.newPeers <- peer:
+	default:
+		return false
+	}
+	s.known[addr] = peer
+
+	return true
+}
+
+// forget drops an address we couldn't connect to or were told is gone, it
+// makes room for new ones and isn't dialed unless somebody brings it up again.
+func (s *swarm) forget(peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.known, peer.String())
+}
+
+// dropped forgets a peer another peer told us went away, unless we are
+// connected to it ourselves.
+func (s *swarm) dropped(peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr := peer.String()
+	if _, ok := s.connected[addr]; ok {
+		return
+	}
+	delete(s.known, addr)
+}
+
+// isKnown reports whether we still want to dial the peer, it can be forgotten
+// while it waits in newPeers.
+func (s *swarm) isKnown(peer Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.known[peer.String()]
+	return ok
+}
+
+// requeue hands a peer we had a working connection to back out of newPeers
+// after the delay, unless it was forgotten by then.
+func (s *swarm) requeue(peer Peer, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if _, ok := s.known[peer.String()]; !ok {
+			return
+		}
+
+		select {
+		case s.newPeers <- peer:
+		default:
+		}
+	})
+}
+
+// acquire blocks until there is room for another connection.
+func (s *swarm) acquire() {
+	s.slots <- struct{}{}
+}
+
+// tryAcquire takes a free connection slot without waiting, it reports
+// whether there was one.
+func (s *swarm) tryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *swarm) release() {
+	<-s.slots
+}
+
+func (s *swarm) connect(peer Peer, flags byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connected[peer.String()] = swarmPeer{peer, flags}
+}
+
+func (s *swarm) disconnect(peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.connected, peer.String())
+}
+
+func (s *swarm) connectedPeers() []swarmPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]swarmPeer, 0, len(s.connected))
+	for _, p := range s.connected {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+func (s *swarm) knownPeers() Peers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make(Peers, 0, len(s.known))
+	for _, p := range s.known {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+func (s *swarm) numConnected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.connected)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSwarmForgetMakesRoom(t *testing.T) {
+	s := newSwarm()
+	for i := 0; i < MAXKNOWNPEERS; i++ {
+		s.addPeer(Peer{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 6881})
+	}
+
+	late := Peer{IP: net.IPv4(10, 9, 9, 9), Port: 6881}
+	if s.addPeer(late) {
+		t.Fatalf("expected no room for another address")
+	}
+
+	// an address that failed goes away and the next one fits, once the
+	// queue was worked through
+	for len(s.newPeers) > 0 {
+		<-s.newPeers
+	}
+	s.forget(Peer{IP: net.IPv4(10, 0, 0, 0), Port: 6881})
+	if !s.addPeer(late) {
+		t.Fatalf("expected the address to fit after another was forgotten")
+	}
+}
+
+func TestSwarmRequeue(t *testing.T) {
+	s := newSwarm()
+	peer := Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	gone := Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	s.addPeer(peer)
+	s.addPeer(gone)
+	<-s.newPeers
+	<-s.newPeers
+
+	// a peer that went away comes back to be dialed, unless it was forgotten
+	s.requeue(peer, time.Millisecond)
+	s.requeue(gone, time.Millisecond)
+	s.forget(gone)
+
+	select {
+	case got := <-s.newPeers:
+		if got.String() != peer.String() {
+			t.Fatalf("expected %s to be dialed again, got=%s", peer, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the peer to be dialed again")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if len(s.newPeers) != 0 || s.isKnown(gone) {
+		t.Fatalf("expected the forgotten peer to stay gone")
+	}
+}
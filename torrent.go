@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"errors"
@@ -9,22 +8,41 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/Laseruss/bittorrent-client/bencode"
 )
 
+// PORT is the port we tell trackers and other peers to reach us on
+const PORT = 6881
+
 type TorrentFile struct {
 	name        string
-	length      int
+	length      int // of all the files together
+	files       []fileEntry
 	infoHash    [20]byte
 	pieceLength int
 	pieces      [][20]byte
+	private     bool
+	metadata    []byte // the bencoded info dict
+}
+
+// fileEntry is one of the files of a torrent, the content of a torrent is
+// its files one after the other.
+type fileEntry struct {
+	path   string // slash separated, starting with the name of the torrent
+	length int
+	offset int // where the file starts in the content of the torrent
 }
 
 type Torrent struct {
-	announce string
-	peerID   [20]byte
-	info     *TorrentFile
+	announce     string
+	announceList []string // extra trackers to fall back on, from a magnet link
+	peers        Peers    // peers known before asking the tracker
+	peerID       [20]byte
+	info         *TorrentFile
+	config       Config
+	seeding      bool // we have every piece, the tracker hears we have nothing left
 }
 
 func createPeerId() ([20]byte, error) {
@@ -37,27 +55,19 @@ func createPeerId() ([20]byte, error) {
 	return id, nil
 }
 
-func (t *TorrentFile) calculateInfoHash() {
-	var buf bytes.Buffer
-
-	buf.WriteByte('d')
-	buf.Write(bencode.EncodeString("length"))
-	buf.Write(bencode.EncodeInt(t.length))
-
-	buf.Write(bencode.EncodeString("name"))
-	buf.Write(bencode.EncodeString(t.name))
-
-	buf.Write(bencode.EncodeString("piece length"))
-	buf.Write(bencode.EncodeInt(t.pieceLength))
-
-	buf.Write(bencode.EncodeString("pieces"))
-	buf.WriteString(fmt.Sprintf("%d:", len(t.pieces)*20))
-	for _, p := range t.pieces {
-		buf.Write(p[:])
+// calculateInfoHash hashes the info dict as a whole, so keys we don't parse
+// ourselves still count, and keeps the encoding around to hand to peers that
+// ask for it over ut_metadata.
+func (t *TorrentFile) calculateInfoHash(info bencode.Dictionary) error {
+	raw, err := bencode.Encode(info)
+	if err != nil {
+		return err
 	}
-	buf.WriteByte('e')
 
-	t.infoHash = sha1.Sum(buf.Bytes())
+	t.metadata = raw
+	t.infoHash = sha1.Sum(raw)
+
+	return nil
 }
 
 // We can 100% make this a bit prettier but it parses the map[string]interface to typed structs instead
@@ -78,7 +88,7 @@ func newTorrent(f *os.File) (*Torrent, error) {
 }
 
 func buildTorrent(data bencode.Dictionary) (*Torrent, error) {
-	torrent := &Torrent{}
+	torrent := &Torrent{config: defaultConfig()}
 
 	if _, ok := data["announce"]; !ok {
 		return nil, errors.New("expected announce to exist in torrent")
@@ -98,6 +108,24 @@ func buildTorrent(data bencode.Dictionary) (*Torrent, error) {
 		return nil, errors.New("expected info to be dictionary")
 	}
 
+	file, err := buildInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.info = file
+
+	id, err := createPeerId()
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.peerID = id
+
+	return torrent, nil
+}
+
+func buildInfo(info bencode.Dictionary) (*TorrentFile, error) {
 	file := &TorrentFile{}
 
 	if _, ok := info["name"]; !ok {
@@ -113,19 +141,36 @@ func buildTorrent(data bencode.Dictionary) (*Torrent, error) {
 		return nil, errors.New("expected info dict to contain piece length")
 	}
 	pieceLength, ok := info["piece length"].(int)
-	if !ok {
-		return nil, errors.New("expected piece length to be int")
+	if !ok || pieceLength <= 0 {
+		return nil, errors.New("expected piece length to be a positive int")
 	}
 	file.pieceLength = pieceLength
 
-	if _, ok := info["length"]; !ok {
-		return nil, errors.New("expected info dict to contain length")
-	}
-	length, ok := info["length"].(int)
-	if !ok {
-		return nil, errors.New("expected length to be int")
+	// single file torrents have a length, multi file ones a list of files
+	if _, ok := info["length"]; ok {
+		length, ok := info["length"].(int)
+		if !ok || length < 0 {
+			return nil, errors.New("expected length to be int")
+		}
+
+		// the name is the path of the file on disk
+		err := checkPathElement(file.name)
+		if err != nil {
+			return nil, err
+		}
+		file.length = length
+		file.files = []fileEntry{{path: file.name, length: length}}
+	} else {
+		files, err := buildFiles(file.name, info["files"])
+		if err != nil {
+			return nil, err
+		}
+		file.files = files
+
+		for _, f := range files {
+			file.length += f.length
+		}
 	}
-	file.length = length
 
 	if _, ok := info["pieces"]; !ok {
 		return nil, errors.New("expected info dict to contain pieces")
@@ -151,36 +196,123 @@ func buildTorrent(data bencode.Dictionary) (*Torrent, error) {
 	}
 	file.pieces = p
 
-	torrent.info = file
+	if len(p) != (file.length+pieceLength-1)/pieceLength {
+		return nil, fmt.Errorf("expected %d pieces for the length, got %d", (file.length+pieceLength-1)/pieceLength, len(p))
+	}
 
-	torrent.info.calculateInfoHash()
+	// private torrents (BEP 27) must only get peers from the tracker
+	if private, ok := info["private"].(int); ok && private == 1 {
+		file.private = true
+	}
 
-	id, err := createPeerId()
+	err := file.calculateInfoHash(info)
 	if err != nil {
 		return nil, err
 	}
 
-	torrent.peerID = id
+	return file, nil
+}
 
-	return torrent, nil
+func buildFiles(name string, val interface{}) ([]fileEntry, error) {
+	list, ok := val.(bencode.List)
+	if !ok || len(list) == 0 {
+		return nil, errors.New("expected info dict to contain length or a list of files")
+	}
+
+	// the name is the directory every file goes in
+	err := checkPathElement(name)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []fileEntry{}
+	offset := 0
+	for _, item := range list {
+		dict, ok := item.(bencode.Dictionary)
+		if !ok {
+			return nil, errors.New("expected file to be dictionary")
+		}
+
+		length, ok := dict["length"].(int)
+		if !ok || length < 0 {
+			return nil, errors.New("expected file length to be int")
+		}
+
+		parts, ok := dict["path"].(bencode.List)
+		if !ok || len(parts) == 0 {
+			return nil, errors.New("expected file path to be a list")
+		}
+
+		path := []string{name}
+		for _, part := range parts {
+			b, ok := part.([]byte)
+			if !ok {
+				return nil, errors.New("expected file path to be strings")
+			}
+
+			elem := string(b)
+			err := checkPathElement(elem)
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, elem)
+		}
+
+		files = append(files, fileEntry{
+			path:   strings.Join(path, "/"),
+			length: length,
+			offset: offset,
+		})
+		offset += length
+	}
+
+	return files, nil
 }
 
-func (t *Torrent) buildTrackerURL() (string, error) {
-	base, err := url.Parse(t.announce)
+// checkPathElement makes sure a part of a file path from the info dict keeps
+// the file inside the torrent's directory, the path ends up on disk.
+func checkPathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\") {
+		return fmt.Errorf("file path element %q is not allowed", elem)
+	}
+
+	return nil
+}
+
+func (t *Torrent) buildTrackerURL(announce string) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
+
+	left := t.info.length
+	if t.seeding {
+		left = 0
+	}
+
 	params := url.Values{
 		"info_hash":  []string{string(t.info.infoHash[:])},
 		"peer_id":    []string{string(t.peerID[:])},
-		"port":       []string{"69420"},
+		"port":       []string{strconv.Itoa(PORT)},
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.info.length)},
+		"left":       []string{strconv.Itoa(left)},
 	}
 
 	base.RawQuery = params.Encode()
 
 	return base.String(), nil
 }
+
+// pieceSize is the length of the piece at index, the last piece is usually
+// shorter than the others.
+func (t *TorrentFile) pieceSize(index int) int {
+	begin := index * t.pieceLength
+	end := begin + t.pieceLength
+	if end > t.length {
+		end = t.length
+	}
+
+	return end - begin
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Laseruss/bittorrent-client/bencode"
+)
+
+func multiFileInfo(path ...interface{}) bencode.Dictionary {
+	return bencode.Dictionary{
+		"name":         []byte("album"),
+		"piece length": 16384,
+		"pieces":       make([]byte, 20),
+		"files": bencode.List{
+			bencode.Dictionary{"length": 100, "path": bencode.List{[]byte("cover.jpg")}},
+			bencode.Dictionary{"length": 200, "path": bencode.List(path)},
+		},
+	}
+}
+
+func TestBuildInfoMultiFile(t *testing.T) {
+	info, err := buildInfo(multiFileInfo([]byte("cd1"), []byte("01.flac")))
+	if err != nil {
+		t.Fatalf("could not build info: %s", err)
+	}
+
+	if info.length != 300 || len(info.files) != 2 {
+		t.Fatalf("expected 2 files of 300 bytes, got=%d %d", len(info.files), info.length)
+	}
+	f := info.files[1]
+	if f.path != "album/cd1/01.flac" || f.offset != 100 || f.length != 200 {
+		t.Fatalf("got unexpected file %+v", f)
+	}
+
+	_, err = buildInfo(multiFileInfo([]byte(".."), []byte("escape")))
+	if err == nil {
+		t.Fatalf("expected a path leaving the torrent to be rejected")
+	}
+
+	for _, name := range []string{"..", "../../home", ""} {
+		info := multiFileInfo([]byte("cd1"), []byte("01.flac"))
+		info["name"] = []byte(name)
+		_, err = buildInfo(info)
+		if err == nil {
+			t.Fatalf("expected the name %q to be rejected", name)
+		}
+	}
+}
+
+func TestBuildInfoChecks(t *testing.T) {
+	single := func(name string, pieceLength, length, pieces int) bencode.Dictionary {
+		return bencode.Dictionary{
+			"name":         []byte(name),
+			"piece length": pieceLength,
+			"length":       length,
+			"pieces":       make([]byte, 20*pieces),
+		}
+	}
+
+	_, err := buildInfo(single("debian.iso", 16384, 20000, 2))
+	if err != nil {
+		t.Fatalf("could not build info: %s", err)
+	}
+
+	tests := map[string]bencode.Dictionary{
+		"a name leaving the directory": single("../../.bashrc", 16384, 20000, 2),
+		"a name with a separator":      single("etc/passwd", 16384, 20000, 2),
+		"a zero piece length":          single("debian.iso", 0, 20000, 2),
+		"a negative piece length":      single("debian.iso", -16384, 20000, 2),
+		"too few pieces":               single("debian.iso", 16384, 20000, 1),
+		"too many pieces":              single("debian.iso", 16384, 20000, 3),
+	}
+	for name, info := range tests {
+		_, err := buildInfo(info)
+		if err == nil {
+			t.Fatalf("expected %s to be rejected", name)
+		}
+	}
+}
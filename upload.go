@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// blockRequest is a block a peer asked us for.
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) < 12 {
+		return blockRequest{}, errors.New("the request message was to short")
+	}
+
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+func (r blockRequest) serialize() []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(r.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(r.begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(r.length))
+
+	return payload
+}
+
+// handleUploadMessage handles the messages of a peer downloading from us.
+func (c *client) handleUploadMessage(msg *Message) error {
+	switch msg.ID {
+	case MsgInterested:
+		c.mu.Lock()
+		c.peerInterested = true
+		c.mu.Unlock()
+	case MsgNotInterested:
+		c.mu.Lock()
+		c.peerInterested = false
+		c.mu.Unlock()
+	case MsgRequest:
+		return c.handleRequest(msg.Payload)
+	case MsgCancel:
+		req, err := parseBlockRequest(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.cancelUpload(req)
+	}
+
+	return nil
+}
+
+// handleRequest queues the request if it is for a block we can give the
+// peer, peers with the fast extension hear about the ones we won't answer.
+func (c *client) handleRequest(payload []byte) error {
+	req, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	if !c.queueUpload(req) && c.fast {
+		return c.sendRejectRequest(payload)
+	}
+
+	return nil
+}
+
+func (c *client) queueUpload(req blockRequest) bool {
+	if c.store == nil || req.index < 0 || req.index >= len(c.store.info.pieces) {
+		return false
+	}
+	if req.length <= 0 || req.length > MAXBLOCKSIZE || req.begin < 0 || req.begin+req.length > c.store.info.pieceSize(req.index) {
+		return false
+	}
+	if !c.store.hasPiece(req.index) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a choked peer only gets the pieces of its allowed fast set
+	if c.choking && !c.allowedFastOut[req.index] {
+		return false
+	}
+	if len(c.uploads) >= MAXREQQ {
+		return false
+	}
+	for _, r := range c.uploads {
+		if r == req {
+			return true // asked twice, it is already on its way
+		}
+	}
+	c.uploads = append(c.uploads, req)
+
+	select {
+	case c.uploadReady <- struct{}{}:
+	default: // the upload loop already has a wake up waiting
+	}
+
+	return true
+}
+
+func (c *client) cancelUpload(req blockRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, r := range c.uploads {
+		if r == req {
+			c.uploads = append(c.uploads[:i], c.uploads[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *client) nextUpload() (blockRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.uploads) == 0 {
+		return blockRequest{}, false
+	}
+
+	req := c.uploads[0]
+	c.uploads = c.uploads[1:]
+
+	return req, true
+}
+
+// serveUploads sends the blocks the peer asked for until the connection is
+// closed, it runs next to the worker of the connection.
+func (c *client) serveUploads() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.uploadReady:
+		}
+
+		for {
+			req, ok := c.nextUpload()
+			if !ok {
+				break
+			}
+
+			block, err := c.store.readBlock(req.index, req.begin, req.length)
+			if err != nil {
+				continue
+			}
+
+			err = c.sendPiece(req, block)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *client) isChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.choking
+}
+
+// sendChoke stops uploading to the peer, the requests it has queued are
+// dropped, peers with the fast extension get a reject for each of them.
+func (c *client) sendChoke() error {
+	c.mu.Lock()
+	c.choking = true
+
+	dropped := []blockRequest{}
+	kept := []blockRequest{}
+	for _, req := range c.uploads {
+		if c.allowedFastOut[req.index] {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	c.uploads = kept
+	c.mu.Unlock()
+
+	msg := Message{ID: MsgChoke}
+	err := c.write(msg.serialize())
+	if err != nil {
+		return err
+	}
+
+	if !c.fast {
+		return nil
+	}
+	for _, req := range dropped {
+		err = c.sendRejectRequest(req.serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *client) sendPiece(req blockRequest, block []byte) error {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+	copy(payload[8:], block)
+
+	msg := Message{ID: MsgPiece, Payload: payload}
+	err := c.write(msg.serialize())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.uploaded += len(block)
+	c.mu.Unlock()
+	if c.stats != nil {
+		c.stats.uploaded.Add(int64(len(block)))
+	}
+
+	return nil
+}
+
+// serve answers the peer when we have nothing left to download from it.
+func serve(c *client) {
+	for msg := range c.incoming {
+		err := c.handleMessage(msg)
+		if err != nil {
+			fmt.Println("dropping peer", c.peer.IP, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// testTorrent cuts data into pieces of pieceLength and hashes them.
+func testTorrent(data []byte, pieceLength int) *TorrentFile {
+	info := &TorrentFile{name: "test.txt", length: len(data), pieceLength: pieceLength}
+	info.files = []fileEntry{{path: info.name, length: len(data)}}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		info.pieces = append(info.pieces, sha1.Sum(data[begin:end]))
+	}
+
+	return info
+}
+
+func requestMsg(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return &Message{ID: MsgRequest, Payload: payload}
+}
+
+func TestLoadPieceStore(t *testing.T) {
+	data := bytes.Repeat([]byte("seed"), 10000)
+	info := testTorrent(data, 16384)
+
+	st, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+	if !st.complete() {
+		t.Fatalf("expected the store to be complete")
+	}
+
+	broken := append([]byte{}, data...)
+	broken[len(broken)-1] ^= 1
+	_, err = loadPieceStore(info, newMemoryStorage(info, broken))
+	if err == nil {
+		t.Fatalf("expected a broken last piece to fail")
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	data := bytes.Repeat([]byte("seed"), 10000)
+	info := testTorrent(data, 16384)
+	st, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+
+	c := &client{
+		conn:        ours,
+		store:       st,
+		fast:        true,
+		bitfield:    newBitfield(len(info.pieces)),
+		done:        make(chan struct{}),
+		incoming:    make(chan *Message),
+		uploadReady: make(chan struct{}, 1),
+	}
+	defer c.close()
+	c.choking = false
+	go c.readLoop()
+	go c.serveUploads()
+	go serve(c)
+
+	// the last piece is short, a full block from it is out of range
+	theirs.Write(requestMsg(2, 0, 16384).serialize())
+	msg, err := readMessage(theirs)
+	if err != nil || msg.ID != MsgRejectRequest {
+		t.Fatalf("expected a reject, got=%v %v", msg, err)
+	}
+
+	theirs.Write(requestMsg(2, 0, 40000-2*16384).serialize())
+	msg, err = readMessage(theirs)
+	if err != nil || msg.ID != MsgPiece {
+		t.Fatalf("expected a piece, got=%v %v", msg, err)
+	}
+	if !bytes.Equal(msg.Payload[8:], data[2*16384:]) {
+		t.Fatalf("got the wrong block")
+	}
+}
+
+func TestCancelUpload(t *testing.T) {
+	data := bytes.Repeat([]byte("seed"), 10000)
+	info := testTorrent(data, 16384)
+	st, err := loadPieceStore(info, newMemoryStorage(info, data))
+	if err != nil {
+		t.Fatalf("could not load the store: %s", err)
+	}
+
+	c := &client{store: st, choking: true, uploadReady: make(chan struct{}, 1)}
+
+	// nothing goes through while we choke the peer
+	if c.queueUpload(blockRequest{0, 0, 16384}) {
+		t.Fatalf("expected a choked peer's request to be refused")
+	}
+
+	c.choking = false
+	c.queueUpload(blockRequest{0, 0, 16384})
+	c.queueUpload(blockRequest{1, 0, 16384})
+	c.cancelUpload(blockRequest{0, 0, 16384})
+
+	req, ok := c.nextUpload()
+	if !ok || req != (blockRequest{1, 0, 16384}) {
+		t.Fatalf("expected the second request to be left, got=%v", req)
+	}
+	if _, ok := c.nextUpload(); ok {
+		t.Fatalf("expected the queue to be empty")
+	}
+}
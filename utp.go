@@ -0,0 +1,946 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uTP (BEP 29) runs reliable, ordered streams over UDP and backs off as soon
+// as it sees queuing delay build up, so it doesn't crowd out other traffic on
+// the link. All connections share one UDP socket.
+
+const (
+	UTPHEADERSIZE   = 20
+	UTPPAYLOADSIZE  = 1200           // data in a single packet, small enough to not fragment
+	UTPRECVWINDOW   = 1 << 20        // bytes we let the other side have in flight
+	UTPTARGETDELAY  = 100000         // LEDBAT target queuing delay in microseconds
+	UTPMAXGAIN      = 3000           // max window growth in bytes per round trip
+	UTPMINWINDOW    = UTPPAYLOADSIZE // the window never shrinks below a packet
+	UTPINITWINDOW   = 4 * UTPPAYLOADSIZE
+	UTPMINRTO       = 500 * time.Millisecond
+	UTPMAXRTO       = 30 * time.Second // give up on the connection after this
+	UTPTICK         = 50 * time.Millisecond
+	UTPSYNRETRIES   = 4
+	UTPACCEPTQUEUE  = 32
+	UTPDUPACKRESEND = 3 // duplicate acks before we resend without waiting for the timeout
+)
+
+// Packet types
+const (
+	utpData  uint8 = 0
+	utpFin   uint8 = 1
+	utpState uint8 = 2
+	utpReset uint8 = 3
+	utpSyn   uint8 = 4
+)
+
+const utpVersion = 1
+
+// the only extension we speak, selective acks
+const utpExtSack uint8 = 1
+
+// Connection states
+const (
+	utpSynSent = iota
+	utpConnected
+	utpClosed // we sent a fin, or saw a reset
+)
+
+var (
+	errUTPReset  = errors.New("utp: connection reset by peer")
+	errUTPClosed = errors.New("utp: use of closed connection")
+	errUTPTimout = errors.New("utp: connection timed out")
+)
+
+type utpPacket struct {
+	typ     uint8
+	connID  uint16
+	ts      uint32 // microseconds
+	tsDiff  uint32
+	wnd     uint32
+	seq     uint16
+	ack     uint16
+	sack    []byte // selective ack bitmask, nil when there is none
+	payload []byte
+}
+
+func (p *utpPacket) serialize() []byte {
+	size := UTPHEADERSIZE + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+
+	buf := make([]byte, size)
+	buf[0] = p.typ<<4 | utpVersion
+	if p.sack != nil {
+		buf[1] = utpExtSack
+	}
+	binary.BigEndian.PutUint16(buf[2:4], p.connID)
+	binary.BigEndian.PutUint32(buf[4:8], p.ts)
+	binary.BigEndian.PutUint32(buf[8:12], p.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], p.seq)
+	binary.BigEndian.PutUint16(buf[18:20], p.ack)
+
+	curr := UTPHEADERSIZE
+	if p.sack != nil {
+		buf[curr] = 0 // no extension after this one
+		buf[curr+1] = byte(len(p.sack))
+		curr += 2
+		curr += copy(buf[curr:], p.sack)
+	}
+	copy(buf[curr:], p.payload)
+
+	return buf
+}
+
+func deserializeUTPPacket(buf []byte) (*utpPacket, error) {
+	if len(buf) < UTPHEADERSIZE {
+		return nil, errors.New("utp: packet too short")
+	}
+	if buf[0]&0x0f != utpVersion {
+		return nil, errors.New("utp: unknown version")
+	}
+
+	p := &utpPacket{
+		typ:    buf[0] >> 4,
+		connID: binary.BigEndian.Uint16(buf[2:4]),
+		ts:     binary.BigEndian.Uint32(buf[4:8]),
+		tsDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wnd:    binary.BigEndian.Uint32(buf[12:16]),
+		seq:    binary.BigEndian.Uint16(buf[16:18]),
+		ack:    binary.BigEndian.Uint16(buf[18:20]),
+	}
+	if p.typ > utpSyn {
+		return nil, errors.New("utp: unknown packet type")
+	}
+
+	ext := buf[1]
+	curr := UTPHEADERSIZE
+	for ext != 0 {
+		if len(buf) < curr+2 {
+			return nil, errors.New("utp: extension header too short")
+		}
+		next, l := buf[curr], int(buf[curr+1])
+		curr += 2
+		if len(buf) < curr+l {
+			return nil, errors.New("utp: extension too short")
+		}
+		if ext == utpExtSack {
+			p.sack = buf[curr : curr+l]
+		}
+		curr += l
+		ext = next
+	}
+	p.payload = buf[curr:]
+
+	return p, nil
+}
+
+// seqLess compares sequence numbers that wrap around at 2^16.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+type utpKey struct {
+	addr string
+	id   uint16 // the connection id the other side sends us
+}
+
+type utpSocket struct {
+	pc     net.PacketConn
+	accept chan *utpConn
+	done   chan struct{}
+
+	mu    sync.Mutex
+	conns map[utpKey]*utpConn
+	// drop decides if an outgoing packet gets lost, tests use it to
+	// simulate a bad link
+	drop func() bool
+}
+
+func listenUTP(addr string) (*utpSocket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &utpSocket{
+		pc:     pc,
+		accept: make(chan *utpConn, UTPACCEPTQUEUE),
+		done:   make(chan struct{}),
+		conns:  make(map[utpKey]*utpConn),
+	}
+	go s.readLoop()
+
+	return s, nil
+}
+
+var (
+	sharedUTPOnce sync.Once
+	sharedUTP     *utpSocket
+	sharedUTPErr  error
+)
+
+// sharedUTPSocket is the socket every utp connection of the process goes
+// through, on our port when it is free.
+func sharedUTPSocket() (*utpSocket, error) {
+	sharedUTPOnce.Do(func() {
+		sharedUTP, sharedUTPErr = listenUTP(":" + strconv.Itoa(PORT))
+		if sharedUTPErr != nil {
+			sharedUTP, sharedUTPErr = listenUTP(":0")
+		}
+	})
+
+	return sharedUTP, sharedUTPErr
+}
+
+func dialUTP(addr string, timeout time.Duration) (net.Conn, error) {
+	s, err := sharedUTPSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dial(addr, timeout)
+}
+
+func (s *utpSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *utpSocket) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+
+	return s.pc.Close()
+}
+
+func (s *utpSocket) send(addr net.Addr, p *utpPacket) error {
+	s.mu.Lock()
+	drop := s.drop
+	s.mu.Unlock()
+
+	if drop != nil && drop() {
+		return nil
+	}
+
+	_, err := s.pc.WriteTo(p.serialize(), addr)
+	return err
+}
+
+func (s *utpSocket) register(c *utpConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := utpKey{c.raddr.String(), c.recvID}
+	if _, ok := s.conns[key]; ok {
+		return false
+	}
+	s.conns[key] = c
+
+	return true
+}
+
+func (s *utpSocket) unregister(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, utpKey{c.raddr.String(), c.recvID})
+}
+
+func (s *utpSocket) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *utpConn
+	for {
+		var id [2]byte
+		_, err = rand.Read(id[:])
+		if err != nil {
+			return nil, err
+		}
+
+		recvID := binary.BigEndian.Uint16(id[:])
+		c = newUTPConn(s, raddr, recvID, recvID+1)
+		if s.register(c) {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.state = utpSynSent
+	c.sendPacket(utpSyn, nil)
+	c.mu.Unlock()
+	go c.run()
+
+	deadline := time.Now().Add(timeout)
+	c.SetDeadline(deadline)
+	defer c.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state == utpSynSent && c.err == nil && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+
+	if c.state != utpConnected {
+		if c.err == nil {
+			c.err = errUTPTimout
+		}
+		err := c.err
+		c.state = utpClosed
+		c.cond.Broadcast()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// acceptConn waits for the next connection a peer opens to the socket.
+func (s *utpSocket) acceptConn(done <-chan struct{}) (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-done:
+		return nil, errUTPClosed
+	case <-s.done:
+		return nil, errUTPClosed
+	}
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue // icmp errors and the like
+			}
+		}
+
+		p, err := deserializeUTPPacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+
+		// a syn carries the id the other side receives with, the conn we
+		// accepted for it is registered under that id plus one
+		recvID := p.connID
+		if p.typ == utpSyn {
+			recvID++
+		}
+
+		s.mu.Lock()
+		c, ok := s.conns[utpKey{addr.String(), recvID}]
+		s.mu.Unlock()
+
+		if ok {
+			c.handle(p)
+			continue
+		}
+
+		if p.typ == utpSyn {
+			s.handleSyn(addr, p)
+		} else if p.typ != utpReset {
+			s.send(addr, &utpPacket{typ: utpReset, connID: p.connID, ts: nowMicro(), ack: p.seq})
+		}
+	}
+}
+
+func (s *utpSocket) handleSyn(addr net.Addr, p *utpPacket) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	// the other side sends with the id it picked plus one and wants us to
+	// send with the id it picked
+	c := newUTPConn(s, raddr, p.connID+1, p.connID)
+	c.state = utpConnected
+	c.ackNr = p.seq
+
+	var seq [2]byte
+	rand.Read(seq[:])
+	c.seq = binary.BigEndian.Uint16(seq[:])
+
+	if !s.register(c) {
+		return // the id is taken by a connection of our own
+	}
+
+	select {
+	case s.accept <- c:
+	default:
+		s.unregister(c)
+		s.send(addr, &utpPacket{typ: utpReset, connID: c.sendID, ts: nowMicro(), ack: p.seq})
+		return
+	}
+
+	c.mu.Lock()
+	c.replyMicro = nowMicro() - p.ts
+	c.sendState()
+	c.mu.Unlock()
+	go c.run()
+}
+
+type utpOutPacket struct {
+	p           *utpPacket
+	sentAt      time.Time
+	transmits   int
+	needResend  bool
+	sackedAfter int // packets after this one the other side selectively acked
+}
+
+type utpConn struct {
+	sock   *utpSocket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error // set when the connection broke
+	fin   bool  // we got every byte up to the other side's fin
+
+	// sending
+	seq       uint16 // the next sequence number we send
+	outbuf    []*utpOutPacket
+	inflight  int
+	maxWindow float64 // LEDBAT congestion window in bytes
+	peerWnd   int
+	lastAck   uint16
+	dupAcks   int
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	closing   bool // Close was called and the fin went out, run stays until outbuf drains
+
+	// receiving
+	ackNr      uint16 // the last sequence number we got in order
+	readBuf    []byte
+	ooo        map[uint16]*utpPacket
+	finSeq     uint16
+	gotFin     bool
+	replyMicro uint32
+
+	// delay based congestion control
+	baseDelays  [2]uint32 // lowest delay seen in the current and last minute
+	baseMinute  int64
+	lastRecvAt  time.Time
+	readDeadln  time.Time
+	writeDeadln time.Time
+	readTimer   *time.Timer
+	writeTimer  *time.Timer
+}
+
+func newUTPConn(s *utpSocket, raddr *net.UDPAddr, recvID, sendID uint16) *utpConn {
+	c := &utpConn{
+		sock:       s,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		seq:        1,
+		maxWindow:  UTPINITWINDOW,
+		peerWnd:    UTPRECVWINDOW,
+		rto:        time.Second,
+		ooo:        make(map[uint16]*utpPacket),
+		baseDelays: [2]uint32{^uint32(0), ^uint32(0)},
+		lastRecvAt: time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// sendPacket sends a packet that takes up a sequence number and keeps it
+// until it is acked. The caller holds c.mu.
+func (c *utpConn) sendPacket(typ uint8, payload []byte) {
+	p := &utpPacket{
+		typ:     typ,
+		connID:  c.sendID,
+		seq:     c.seq,
+		payload: payload,
+	}
+	if typ == utpSyn {
+		p.connID = c.recvID
+	}
+	c.seq++
+
+	out := &utpOutPacket{p: p}
+	c.outbuf = append(c.outbuf, out)
+	c.inflight += len(payload)
+	c.transmit(out)
+}
+
+func (c *utpConn) transmit(out *utpOutPacket) {
+	out.p.ts = nowMicro()
+	out.p.tsDiff = c.replyMicro
+	out.p.wnd = uint32(c.recvWindow())
+	out.p.ack = c.ackNr
+	out.sentAt = time.Now()
+	out.transmits++
+	out.needResend = false
+
+	c.sock.send(c.raddr, out.p)
+}
+
+// sendState acks everything we got so far. The caller holds c.mu.
+func (c *utpConn) sendState() {
+	p := &utpPacket{
+		typ:    utpState,
+		connID: c.sendID,
+		ts:     nowMicro(),
+		tsDiff: c.replyMicro,
+		wnd:    uint32(c.recvWindow()),
+		seq:    c.seq,
+		ack:    c.ackNr,
+		sack:   c.sackMask(),
+	}
+
+	c.sock.send(c.raddr, p)
+}
+
+func (c *utpConn) recvWindow() int {
+	free := UTPRECVWINDOW - len(c.readBuf)
+	if free < 0 {
+		return 0
+	}
+
+	return free
+}
+
+// sackMask marks the packets we got past the first one we are missing, bit 0
+// is ackNr + 2.
+func (c *utpConn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+
+	mask := make([]byte, 4)
+	for seq := range c.ooo {
+		bit := int(seq - c.ackNr - 2)
+		if bit < 0 || bit >= 32 {
+			continue
+		}
+		mask[bit/8] |= 1 << (bit % 8)
+	}
+
+	return mask
+}
+
+func (c *utpConn) handle(p *utpPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	c.lastRecvAt = time.Now()
+
+	if p.typ == utpReset {
+		c.fail(errUTPReset)
+		return
+	}
+
+	if p.typ == utpSyn {
+		c.sendState() // our state packet got lost, send it again
+		return
+	}
+
+	c.replyMicro = nowMicro() - p.ts
+	c.peerWnd = int(p.wnd)
+
+	if c.state == utpSynSent {
+		if p.typ != utpState {
+			return
+		}
+
+		c.state = utpConnected
+		c.ackNr = p.seq - 1
+	}
+
+	c.handleAck(p)
+
+	switch p.typ {
+	case utpData, utpFin:
+		c.handleData(p)
+		c.sendState()
+	}
+}
+
+// handleAck drops what the packet acks from outbuf and grows or shrinks the
+// window. The caller holds c.mu.
+func (c *utpConn) handleAck(p *utpPacket) {
+	acked := 0
+	now := time.Now()
+
+	isAcked := func(seq uint16) bool {
+		if !seqLess(p.ack, seq) {
+			return true
+		}
+
+		bit := int(seq - p.ack - 2)
+		if p.sack == nil || bit < 0 || bit >= len(p.sack)*8 {
+			return false
+		}
+
+		return p.sack[bit/8]&(1<<(bit%8)) != 0
+	}
+
+	remaining := c.outbuf[:0]
+	for _, out := range c.outbuf {
+		if !isAcked(out.p.seq) {
+			remaining = append(remaining, out)
+			continue
+		}
+
+		acked += len(out.p.payload)
+		c.inflight -= len(out.p.payload)
+		// only packets sent once give a clean round trip time
+		if out.transmits == 1 {
+			c.updateRTT(now.Sub(out.sentAt))
+		}
+	}
+	c.outbuf = remaining
+
+	// packets the other side got past the ones still missing point at loss
+	if p.sack != nil {
+		for _, out := range c.outbuf {
+			out.sackedAfter = 0
+			for bit := 0; bit < len(p.sack)*8; bit++ {
+				seq := p.ack + 2 + uint16(bit)
+				if seqLess(out.p.seq, seq) && p.sack[bit/8]&(1<<(bit%8)) != 0 {
+					out.sackedAfter++
+				}
+			}
+			if out.sackedAfter >= UTPDUPACKRESEND && out.transmits == 1 {
+				out.needResend = true
+			}
+		}
+	}
+
+	if p.typ == utpState && acked == 0 && len(c.outbuf) > 0 && p.ack == c.lastAck {
+		c.dupAcks++
+		if c.dupAcks == UTPDUPACKRESEND {
+			c.outbuf[0].needResend = true
+		}
+	} else {
+		c.dupAcks = 0
+	}
+	c.lastAck = p.ack
+
+	resent := false
+	for _, out := range c.outbuf {
+		if out.needResend {
+			c.transmit(out)
+			resent = true
+		}
+	}
+	if resent {
+		c.shrinkWindow(0.5)
+	}
+
+	if acked > 0 && p.tsDiff != 0 {
+		c.ledbat(acked, p.tsDiff)
+	}
+}
+
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < UTPMINRTO {
+		c.rto = UTPMINRTO
+	}
+}
+
+// ledbat moves the window towards keeping UTPTARGETDELAY of queuing delay on
+// the link, delay is how long our packet took to reach the other side.
+func (c *utpConn) ledbat(acked int, delay uint32) {
+	minute := time.Now().Unix() / 60
+	if minute != c.baseMinute {
+		c.baseMinute = minute
+		c.baseDelays[1] = c.baseDelays[0]
+		c.baseDelays[0] = ^uint32(0)
+	}
+	if delay < c.baseDelays[0] {
+		c.baseDelays[0] = delay
+	}
+
+	base := c.baseDelays[0]
+	if c.baseDelays[1] < base {
+		base = c.baseDelays[1]
+	}
+
+	// the clocks of both sides differ, only the part above the lowest delay
+	// we've seen is queuing
+	ourDelay := float64(delay - base)
+	offTarget := (UTPTARGETDELAY - ourDelay) / UTPTARGETDELAY
+	windowFactor := float64(acked) / c.maxWindow
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+
+	c.maxWindow += UTPMAXGAIN * offTarget * windowFactor
+	if c.maxWindow < UTPMINWINDOW {
+		c.maxWindow = UTPMINWINDOW
+	}
+	if c.maxWindow > UTPRECVWINDOW {
+		c.maxWindow = UTPRECVWINDOW
+	}
+}
+
+func (c *utpConn) shrinkWindow(factor float64) {
+	c.maxWindow *= factor
+	if c.maxWindow < UTPMINWINDOW {
+		c.maxWindow = UTPMINWINDOW
+	}
+}
+
+// handleData puts the payload in the read buffer when it is the next one we
+// expect, or holds on to it until the gap before it is filled.
+func (c *utpConn) handleData(p *utpPacket) {
+	if !seqLess(c.ackNr, p.seq) {
+		return // we have it already
+	}
+	if p.seq-c.ackNr > 4096 {
+		return // way outside of any window
+	}
+
+	c.ooo[p.seq] = p
+
+	for {
+		next, ok := c.ooo[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ackNr+1)
+		c.ackNr++
+
+		if next.typ == utpFin {
+			c.gotFin = true
+			c.finSeq = next.seq
+			c.ooo = make(map[uint16]*utpPacket)
+			break
+		}
+		c.readBuf = append(c.readBuf, next.payload...)
+	}
+}
+
+// fail breaks the connection with err. The caller holds c.mu.
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = utpClosed
+}
+
+// run resends packets that time out and cleans up once the connection is
+// done with.
+func (c *utpConn) run() {
+	ticker := time.NewTicker(UTPTICK)
+	defer ticker.Stop()
+	defer c.sock.unregister(c)
+
+	for range ticker.C {
+		c.mu.Lock()
+
+		if c.err != nil || (c.closing && len(c.outbuf) == 0) {
+			c.state = utpClosed
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			return
+		}
+
+		if len(c.outbuf) > 0 && time.Since(c.outbuf[0].sentAt) > c.rto {
+			if c.rto >= UTPMAXRTO || (c.state == utpSynSent && c.outbuf[0].transmits > UTPSYNRETRIES) {
+				c.fail(errUTPTimout)
+				c.cond.Broadcast()
+				c.mu.Unlock()
+				return
+			}
+
+			// on a timeout LEDBAT falls back to a single packet in flight
+			c.maxWindow = UTPMINWINDOW
+			c.rto *= 2
+			c.transmit(c.outbuf[0])
+		}
+
+		c.mu.Unlock()
+	}
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		if c.gotFin {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.closing {
+			return 0, errUTPClosed
+		}
+		if !c.readDeadln.IsZero() && !time.Now().Before(c.readDeadln) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	wasFull := c.recvWindow() < UTPPAYLOADSIZE
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+
+	// let the other side know there's room again
+	if wasFull && c.recvWindow() >= UTPPAYLOADSIZE {
+		c.sendState()
+	}
+
+	return n, nil
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.closing || c.state == utpClosed {
+			return written, errUTPClosed
+		}
+		if !c.writeDeadln.IsZero() && !time.Now().Before(c.writeDeadln) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		size := len(b) - written
+		if size > UTPPAYLOADSIZE {
+			size = UTPPAYLOADSIZE
+		}
+
+		window := int(c.maxWindow)
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+		// always let one packet through so a zero window can't stall us
+		if c.inflight > 0 && c.inflight+size > window {
+			c.cond.Wait()
+			continue
+		}
+
+		payload := append([]byte{}, b[written:written+size]...)
+		c.sendPacket(utpData, payload)
+		written += size
+	}
+
+	return written, nil
+}
+
+// Close sends a fin right away, after the data still waiting for an ack.
+// It does not wait, run keeps resending what is unacked and lets go of the
+// connection once outbuf is empty.
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+
+	if c.err == nil && c.state == utpConnected {
+		c.sendPacket(utpFin, nil)
+	}
+	c.readTimer = c.wakeAt(c.readTimer, time.Time{})
+	c.writeTimer = c.wakeAt(c.writeTimer, time.Time{})
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadln = t
+	c.readTimer = c.wakeAt(c.readTimer, t)
+
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadln = t
+	c.writeTimer = c.wakeAt(c.writeTimer, t)
+
+	return nil
+}
+
+// wakeAt replaces timer with one that wakes up blocked readers and writers
+// at t so they see their deadline passed. The caller holds c.mu.
+func (c *utpConn) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+
+	if t.IsZero() {
+		return nil
+	}
+
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
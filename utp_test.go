@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// utpPair connects two sockets on loopback that drop the given share of the
+// packets they send.
+func utpPair(t *testing.T, loss float64) (*utpSocket, *utpSocket) {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(1))
+	drop := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rng.Float64() < loss
+	}
+
+	a, err := listenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	b, err := listenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	for _, s := range []*utpSocket{a, b} {
+		s.mu.Lock()
+		s.drop = drop
+		s.mu.Unlock()
+	}
+
+	return a, b
+}
+
+func TestUTPPacketRoundTrip(t *testing.T) {
+	p := &utpPacket{typ: utpState, connID: 7, ts: 1, tsDiff: 2, wnd: 3, seq: 65535, ack: 9, sack: []byte{1, 0, 0, 0}, payload: []byte("hi")}
+
+	got, err := deserializeUTPPacket(p.serialize())
+	if err != nil {
+		t.Fatalf("could not deserialize packet: %s", err)
+	}
+
+	if got.typ != p.typ || got.connID != p.connID || got.seq != p.seq || got.ack != p.ack ||
+		!bytes.Equal(got.sack, p.sack) || !bytes.Equal(got.payload, p.payload) {
+		t.Fatalf("expected %+v, got=%+v", p, got)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(65535, 0) || seqLess(0, 65535) || !seqLess(1, 2) || seqLess(5, 5) {
+		t.Fatalf("sequence numbers don't wrap around properly")
+	}
+}
+
+func testUTPTransfer(t *testing.T, loss float64) {
+	a, b := utpPair(t, loss)
+	defer a.Close()
+	defer b.Close()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := b.acceptConn(nil)
+		if err != nil {
+			received <- nil
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got, _ := io.ReadAll(conn)
+		conn.Write([]byte("thanks"))
+		conn.Close()
+		received <- got
+	}()
+
+	conn, err := a.dial(b.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatalf("could not write: %s", err)
+	}
+	conn.Close()
+
+	got := <-received
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected to receive %d bytes intact, got=%d", len(data), len(got))
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	testUTPTransfer(t, 0)
+}
+
+func TestUTPTransferWithLoss(t *testing.T) {
+	testUTPTransfer(t, 0.1)
+}
+
+func TestUTPLostSynAck(t *testing.T) {
+	a, b := utpPair(t, 0)
+	defer a.Close()
+	defer b.Close()
+
+	// the state packet b answers the syn with never arrives, a has to
+	// resend the syn and b has to answer it again
+	var mu sync.Mutex
+	dropped := false
+	b.mu.Lock()
+	b.drop = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		first := !dropped
+		dropped = true
+		return first
+	}
+	b.mu.Unlock()
+
+	go b.acceptConn(nil)
+
+	conn, err := a.dial(b.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("could not dial after losing the syn ack: %s", err)
+	}
+	conn.Close()
+}
+
+func TestUTPReadDeadline(t *testing.T) {
+	a, b := utpPair(t, 0)
+	defer a.Close()
+	defer b.Close()
+
+	go b.acceptConn(nil)
+
+	conn, err := a.dial(b.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("expected the read to time out")
+	}
+}
+
+func TestUTPHandshake(t *testing.T) {
+	a, b := utpPair(t, 0.05)
+	defer a.Close()
+	defer b.Close()
+
+	infoHash := [20]byte{4, 5, 6}
+
+	errs := make(chan error)
+	go func() {
+		conn, err := b.acceptConn(nil)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		_, err = answerHandshake(conn, infoHash, [20]byte{2})
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		msg := Message{ID: MsgHaveNone}
+		_, err = conn.Write(msg.serialize())
+		errs <- err
+	}()
+
+	conn, err := a.dial(b.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	defer conn.Close()
+
+	h, err := completeHandshake(conn, infoHash, [20]byte{1})
+	if err != nil {
+		t.Fatalf("could not complete the handshake: %s", err)
+	}
+	if h.peerID != [20]byte{2} {
+		t.Fatalf("got the wrong peer id %v", h.peerID)
+	}
+
+	msg, err := readMessage(conn)
+	if err != nil || msg.ID != MsgHaveNone {
+		t.Fatalf("expected a have none message, got=%v %v", msg, err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatalf("the accepting side failed: %s", err)
+	}
+}
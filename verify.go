@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+)
+
+// verifyJob is a piece with every block in, waiting for its hash check.
+type verifyJob struct {
+	ap *activePiece
+}
+
+// startVerifiers hashes finished pieces on workers goroutines until the
+// session ends, so a connection can go on with its next piece instead of
+// waiting for the hash. The queue only holds a job per worker, when it is
+// full the connections handing in pieces wait and stop asking for blocks.
+func (sess *session) startVerifiers(workers int) {
+	sess.verifyQ = make(chan verifyJob, workers)
+	for i := 0; i < workers; i++ {
+		go sess.runVerifier()
+	}
+}
+
+// queueVerify hands a complete piece to the verifiers, blocking while they
+// are behind.
+func (sess *session) queueVerify(ap *activePiece) {
+	select {
+	case sess.verifyQ <- verifyJob{ap}:
+	case <-sess.done:
+	}
+}
+
+func (sess *session) runVerifier() {
+	for {
+		select {
+		case job := <-sess.verifyQ:
+			sess.verifyPiece(job.ap)
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+// verifyPiece checks the hash of a piece we have every block of and hands it
+// on, a bad piece is downloaded again. The hash was mostly worked out as the
+// blocks came in.
+func (sess *session) verifyPiece(ap *activePiece) {
+	sess.active.hashBlocks(ap)
+	sum, ok := ap.digest()
+	if !ok || sum != ap.p.hash {
+		fmt.Println("the received piece hash did not match expected")
+		sess.retry(ap)
+		return
+	}
+
+	fresh, err := sess.store.writePiece(ap.p.index, ap.buf)
+	if err != nil {
+		// the piece is fine, we just couldn't keep it, so get it again
+		fmt.Println("could not write piece", ap.p.index, err)
+		sess.retry(ap)
+		return
+	}
+	sess.active.finish(ap)
+	if !fresh {
+		return
+	}
+
+	sess.broadcastHave(ap.p.index)
+
+	select {
+	case sess.results <- &result{ap.p.index}:
+	case <-sess.done:
+	}
+}
+
+// broadcastHave tells every connected peer about a piece we just got, so
+// they can ask us for it.
+func (sess *session) broadcastHave(index int) {
+	for _, c := range sess.choker.clients() {
+		c.sendHave(index)
+		if c.fast && c.allowedFastOut[index] {
+			c.sendAllowedFast(index)
+		}
+	}
+}
+
+// retry throws away the blocks of the piece so they get downloaded again.
+func (sess *session) retry(ap *activePiece) {
+	if sess.active.reset(ap) {
+		sess.picker.putBack(ap.p)
+	}
+}
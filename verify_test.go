@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestVerifyBadPiece(t *testing.T) {
+	data := make([]byte, 2*MAXBLOCKSIZE)
+	rand.Read(data)
+	info := testTorrent(data, len(data))
+	sess := testSession(t, info, newPieceStore(info, newMemoryStorage(info, nil)))
+
+	c := &client{}
+	p := &piece{0, info.pieces[0], len(data)}
+	ap := sess.active.start(p, c)
+	sess.picker.pick(&client{bitfield: fullBitfield(1)})
+
+	sess.active.receive(ap, c, 0, data[:MAXBLOCKSIZE])
+	_, complete := sess.active.receive(ap, c, MAXBLOCKSIZE, make([]byte, MAXBLOCKSIZE))
+	if !complete {
+		t.Fatalf("expected the piece to be complete")
+	}
+
+	// the worker moves on while the piece is checked
+	if sess.active.leave(ap, c) {
+		t.Fatalf("expected a piece in verification to stay off the picker")
+	}
+
+	sess.verifyPiece(ap)
+	if sess.store.hasPiece(0) || sess.active.started(0) {
+		t.Fatalf("expected the bad piece to be thrown away")
+	}
+	if sess.picker.remaining() != 1 {
+		t.Fatalf("expected the bad piece to go back to the picker")
+	}
+}
+
+// benchPieces is 16 MiB of random pieces of 256 KiB.
+func benchPieces() ([]byte, *TorrentFile) {
+	data := make([]byte, 64*262144)
+	rand.Read(data)
+
+	return data, testTorrent(data, 262144)
+}
+
+// discardClient is a connected client whose messages go nowhere.
+func discardClient(b *testing.B) *client {
+	a, other := net.Pipe()
+	go io.Copy(io.Discard, other)
+	b.Cleanup(func() { a.Close(); other.Close() })
+
+	return &client{conn: a}
+}
+
+// receiveAll hands the blocks in data to the piece in order, without
+// hashing them.
+func receiveAll(a *activePieces, ap *activePiece, data []byte) {
+	for begin := 0; begin < len(data); begin += MAXBLOCKSIZE {
+		a.receive(ap, nil, begin, data[begin:begin+blockSize(ap.p.length, begin)])
+	}
+}
+
+// verifySession is just enough of a session for the verifiers, without the
+// choker of testSession running next to the benchmark.
+func verifySession(info *TorrentFile) (*session, chan struct{}) {
+	st := newPieceStore(info, newMemoryStorage(info, nil))
+	active := newActivePieces()
+	done := make(chan struct{})
+
+	sess := &session{
+		t:       &Torrent{info: info, config: defaultConfig()},
+		store:   st,
+		choker:  newChoker(defaultConfig(), st),
+		active:  active,
+		picker:  newPicker(info, st, active, RarestFirst{}),
+		results: make(chan *result),
+		done:    done,
+	}
+	sess.startVerifiers(runtime.NumCPU())
+
+	return sess, done
+}
+
+// BenchmarkVerifyPieces compares hashing every piece on the connection that
+// finished it, like we used to, to handing them to the verifier pool.
+func BenchmarkVerifyPieces(b *testing.B) {
+	data, info := benchPieces()
+
+	b.Run("inline", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			st := newPieceStore(info, newMemoryStorage(info, nil))
+			for index, hash := range info.pieces {
+				p := &piece{index, hash, info.pieceSize(index)}
+				buf := data[index*info.pieceLength : index*info.pieceLength+p.length]
+				if checkIntegrity(p, buf) {
+					st.writePiece(index, buf)
+				}
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		c := discardClient(b)
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			sess, done := verifySession(info)
+			aps := make([]*activePiece, len(info.pieces))
+			for index, hash := range info.pieces {
+				aps[index] = sess.active.start(&piece{index, hash, info.pieceSize(index)}, c)
+				begin := index * info.pieceLength
+				receiveAll(sess.active, aps[index], data[begin:begin+info.pieceSize(index)])
+			}
+			b.StartTimer()
+
+			go func() {
+				for _, ap := range aps {
+					sess.queueVerify(ap)
+				}
+			}()
+			for range info.pieces {
+				<-sess.results
+			}
+
+			b.StopTimer()
+			close(done)
+			b.StartTimer()
+		}
+	})
+}
+
+// BenchmarkRecheck compares hashing the pieces one after the other to
+// hashing them on every core.
+func BenchmarkRecheck(b *testing.B) {
+	data, info := benchPieces()
+
+	bench := func(workers int) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				recheckWith(newPieceStore(info, newMemoryStorage(info, data)), workers)
+			}
+		}
+	}
+
+	b.Run("sequential", bench(1))
+	b.Run("parallel", bench(runtime.NumCPU()))
+}
+
+// BenchmarkPieceHash compares hashing a piece once it is complete, like
+// checkIntegrity does, to hashing the blocks as they come in. The last
+// block benchmarks are the time from the last block to a verified piece.
+func BenchmarkPieceHash(b *testing.B) {
+	data, info := benchPieces()
+	p := &piece{0, info.pieces[0], info.pieceLength}
+	piece := data[:p.length]
+
+	b.Run("full", func(b *testing.B) {
+		b.SetBytes(int64(p.length))
+		for i := 0; i < b.N; i++ {
+			a := newActivePieces()
+			ap := a.start(p, nil)
+			receiveAll(a, ap, piece)
+			if !checkIntegrity(p, ap.buf) {
+				b.Fatalf("expected the piece to match")
+			}
+		}
+	})
+
+	b.Run("incremental", func(b *testing.B) {
+		b.SetBytes(int64(p.length))
+		for i := 0; i < b.N; i++ {
+			a := newActivePieces()
+			ap := a.start(p, nil)
+			for begin := 0; begin < p.length; begin += MAXBLOCKSIZE {
+				a.receive(ap, nil, begin, piece[begin:begin+MAXBLOCKSIZE])
+				a.hashBlocks(ap)
+			}
+			if sum, ok := ap.digest(); !ok || sum != p.hash {
+				b.Fatalf("expected the piece to match")
+			}
+		}
+	})
+
+	last := p.length - MAXBLOCKSIZE
+
+	b.Run("full/last block", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			a := newActivePieces()
+			ap := a.start(p, nil)
+			receiveAll(a, ap, piece[:last])
+			b.StartTimer()
+
+			a.receive(ap, nil, last, piece[last:])
+			if !checkIntegrity(p, ap.buf) {
+				b.Fatalf("expected the piece to match")
+			}
+		}
+	})
+
+	b.Run("incremental/last block", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			a := newActivePieces()
+			ap := a.start(p, nil)
+			receiveAll(a, ap, piece[:last])
+			a.hashBlocks(ap)
+			b.StartTimer()
+
+			a.receive(ap, nil, last, piece[last:])
+			a.hashBlocks(ap)
+			if sum, ok := ap.digest(); !ok || sum != p.hash {
+				b.Fatalf("expected the piece to match")
+			}
+		}
+	})
+}